@@ -20,4 +20,6 @@ DESTINATION=$destination IMAGE_REGISTRY=registry:5000 make manifests
 ./cluster/kubectl.sh delete --ignore-not-found ds macvtap-cni
 
 ./cluster/kubectl.sh create -f examples/macvtap-deviceplugin-config-default.yaml
+./cluster/kubectl.sh apply -f _out/manifests/crd.yaml
+./cluster/kubectl.sh apply -f _out/manifests/rbac.yaml
 ./cluster/kubectl.sh create -f _out/manifests/macvtap.yaml
@@ -8,5 +8,11 @@ import (
 )
 
 func main() {
-	skel.PluginMain(macvtap_cni.CmdAdd, macvtap_cni.CmdCheck, macvtap_cni.CmdDel, version.All, bv.BuildString("macvtap"))
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    macvtap_cni.CmdAdd,
+		Del:    macvtap_cni.CmdDel,
+		Check:  macvtap_cni.CmdCheck,
+		GC:     macvtap_cni.CmdGC,
+		Status: macvtap_cni.CmdStatus,
+	}, version.All, bv.BuildString("macvtap"))
 }
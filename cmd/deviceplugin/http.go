@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	macvtap "github.com/kubevirt/macvtap-cni/pkg/deviceplugin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// healthChecker tells whether the device plugin is alive and ready.
+type healthChecker interface {
+	Alive(linkSubscriptionTimeout time.Duration) error
+	Ready() error
+}
+
+// serveHTTP serves the metrics and the health endpoints of the device plugin
+// on their addresses, with a single server if they are the same.
+func serveHTTP(metricsAddress, healthAddress string, health healthChecker) {
+	muxes := make(map[string]*http.ServeMux)
+	muxFor := func(address string) *http.ServeMux {
+		if _, ok := muxes[address]; !ok {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+
+	if metricsAddress != "" {
+		muxFor(metricsAddress).Handle("/metrics", promhttp.HandlerFor(macvtap.Registry, promhttp.HandlerOpts{}))
+	}
+	if healthAddress != "" {
+		mux := muxFor(healthAddress)
+		mux.Handle("/healthz", checkHandler(func() error {
+			return health.Alive(linkSubscriptionTimeout)
+		}))
+		mux.Handle("/readyz", checkHandler(health.Ready))
+	}
+
+	for address, mux := range muxes {
+		server := &http.Server{
+			Addr:              address,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			glog.Infof("Serving HTTP on %s", server.Addr)
+			if err := server.ListenAndServe(); err != nil {
+				glog.Errorf("HTTP server on %s failed: %v", server.Addr, err)
+			}
+		}()
+	}
+}
+
+// checkHandler answers 200 if the check passes, and 503 with the error
+// otherwise.
+func checkHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if err := check(); err != nil {
+			glog.V(3).Infof("Health check failed: %v", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
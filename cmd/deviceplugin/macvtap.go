@@ -2,17 +2,31 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
 	macvtap "github.com/kubevirt/macvtap-cni/pkg/deviceplugin"
 	"github.com/kubevirt/macvtap-cni/pkg/util"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	AddFlags(flag.CommandLine)
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "sort-devices" {
+			glog.Warning("--sort-devices is deprecated and ignored, set allocationPolicy in the resource configuration instead")
+		}
+	})
 	// Device plugin operates with several goroutines that might be
 	// relocated among different OS threads with different namespaces.
 	// We capture the main namespace here and make sure that we do any
@@ -23,18 +37,134 @@ func main() {
 
 	listerType := macvtap.ListerTypeConfigEnv
 	_, configDefined := os.LookupEnv(macvtap.EnvName)
-	if !configDefined {
+	if resourcePools {
+		listerType = macvtap.ListerTypeResourcePool
+	} else if !configDefined {
 		glog.Warningf("not found environment variable [%s], try use ConfigPath mode", macvtap.EnvName)
 		//glog.Exitf("%s environment variable must be set", macvtap.ConfigEnvironmentVariable)
 		listerType = macvtap.ListerTypeConfigPath
 	}
 	glog.Infoln("current use lister type: ", listerType)
-	manager := dpm.NewManager(macvtap.NewMacvtapLister(mainNsPath, listerType))
+
+	setupEvents()
+
+	if gcInterval > 0 {
+		collector := macvtap.NewLeakedLinkCollector(mainNsPath, macvtap.PodResourcesSocket, gcInterval, gcGracePeriod)
+		go collector.Run(make(chan struct{}))
+	}
+
+	lister := macvtap.NewMacvtapLister(mainNsPath, listerType)
+	lister.Node = nodeSource()
+	if resourcePools {
+		source, err := resourcePoolSource()
+		if err != nil {
+			glog.Exitf("MacvtapResourcePools can not be read: %v", err)
+		}
+		lister = macvtap.NewResourcePoolLister(mainNsPath, source)
+	}
+	if metricsAddress != "" && podTrafficMetrics {
+		macvtap.Registry.MustRegister(macvtap.NewPodTrafficCollector(macvtap.PodResourcesSocket))
+	}
+	serveHTTP(metricsAddress, healthAddress, lister)
+
+	manager := dpm.NewManager(lister)
 	manager.Run()
 }
 
+// inClusterConfig returns the client configuration and the name of the node
+// when running in a cluster, the node name being set by the downward API.
+func inClusterConfig() (*rest.Config, string, error) {
+	nodeName := os.Getenv(nodeNameEnv)
+	if nodeName == "" {
+		return nil, "", fmt.Errorf("%s is not set", nodeNameEnv)
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	return config, nodeName, nil
+}
+
+// setupEvents records Events on the node when running in a cluster.
+func setupEvents() {
+	config, nodeName, err := inClusterConfig()
+	if err != nil {
+		glog.Warningf("Events will not be recorded: %v", err)
+		return
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		glog.Warningf("Events will not be recorded: %v", err)
+		return
+	}
+	macvtap.Events = macvtap.NewNodeEventRecorder(client, nodeName)
+}
+
+// nodeSource returns the node the overrides of the configuration are
+// selected for, if known.
+func nodeSource() *macvtap.NodeSource {
+	nodeName := os.Getenv(nodeNameEnv)
+	if nodeName == "" {
+		glog.Warningf("%s is not set, node overrides of the configuration will not apply", nodeNameEnv)
+		return nil
+	}
+	node := &macvtap.NodeSource{Name: nodeName}
+	config, _, err := inClusterConfig()
+	if err == nil {
+		node.Client, err = kubernetes.NewForConfig(config)
+	}
+	if err != nil {
+		glog.Warningf("Node overrides of the configuration by label selector will not apply: %v", err)
+	}
+	return node
+}
+
+func resourcePoolSource() (*macvtap.ResourcePoolSource, error) {
+	config, nodeName, err := inClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &macvtap.ResourcePoolSource{
+		Client:     client,
+		KubeClient: kubeClient,
+		NodeName:   nodeName,
+	}, nil
+}
+
+const nodeNameEnv = "NODE_NAME"
+
+var (
+	gcInterval     time.Duration
+	gcGracePeriod  time.Duration
+	resourcePools  bool
+	metricsAddress string
+	healthAddress  string
+
+	podTrafficMetrics bool
+
+	linkSubscriptionTimeout time.Duration
+)
+
 func AddFlags(fs *flag.FlagSet) {
 	fs.StringVar(&macvtap.EnvName, "env-name", macvtap.ConfigEnvironmentVariable, "Custom config environment name")
 	fs.StringVar(&macvtap.ConfigMapFilePath, "config-path", macvtap.ConfigMapDefaultPath, "Custom config file path")
-	fs.BoolVar(&macvtap.SortDeviceIds, "sort-devices", true, "Enable preferred allocation sort device ids")
+	fs.StringVar(&macvtap.PodResourcesSocket, "pod-resources-socket", macvtap.PodResourcesSocket, "Kubelet PodResources API socket")
+	fs.DurationVar(&gcInterval, "gc-interval", macvtap.DefaultGCInterval, "Interval at which leaked macvtap links are looked for, 0 to disable")
+	fs.DurationVar(&gcGracePeriod, "gc-grace-period", macvtap.DefaultGCGracePeriod, "Time a macvtap link must be owned by no pod before it is deleted")
+	fs.StringVar(&metricsAddress, "metrics-address", "", "Address to serve Prometheus metrics on, such as :9500, none if empty")
+	fs.BoolVar(&podTrafficMetrics, "pod-traffic-metrics", true, "Export the traffic statistics of the links allocated to pods along the metrics")
+	fs.StringVar(&healthAddress, "health-address", "", "Address to serve the /healthz and /readyz endpoints on, such as :9500, none if empty")
+	fs.DurationVar(&linkSubscriptionTimeout, "link-subscription-timeout", macvtap.DefaultLinkSubscriptionTimeout, "Time a link event subscription may be down before /healthz fails")
+	fs.BoolVar(&resourcePools, "resource-pools", false, "Read the configuration from the MacvtapResourcePools selecting the node")
+	// Superseded by the allocationPolicy of each resource, kept so that
+	// existing deployments keep starting
+	fs.Bool("sort-devices", true, "Deprecated: set allocationPolicy in the resource configuration instead")
 }
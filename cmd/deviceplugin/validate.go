@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	macvtap "github.com/kubevirt/macvtap-cni/pkg/deviceplugin"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// validate checks a configuration offline, as the device plugin would on
+// load, and returns the exit code.
+func validate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	envName := fs.String("env", "", "Validate the configuration held by this environment variable instead of a file")
+	nodeName := fs.String("node", "", "Print the resources of the node of this name")
+	nodeLabels := fs.String("node-labels", "", "Labels of the node, as comma separated key=value pairs")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s validate [-node NAME [-node-labels LABELS]] [-env NAME | FILE]\n\nFILE defaults to %s.\n", os.Args[0], macvtap.ConfigMapDefaultPath)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var data []byte
+	switch {
+	case *envName != "":
+		value, ok := os.LookupEnv(*envName)
+		if !ok {
+			fmt.Fprintf(stderr, "environment variable %s is not set\n", *envName)
+			return 1
+		}
+		data = []byte(value)
+	case fs.NArg() > 1:
+		fs.Usage()
+		return 2
+	default:
+		path := macvtap.ConfigMapDefaultPath
+		if fs.NArg() == 1 {
+			path = fs.Arg(0)
+		}
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+
+	var node *macvtap.NodeSource
+	if *nodeName != "" {
+		set, err := labels.ConvertSelectorToLabelsMap(*nodeLabels)
+		if err != nil {
+			fmt.Fprintf(stderr, "invalid node labels: %v\n", err)
+			return 2
+		}
+		node = &macvtap.NodeSource{Name: *nodeName, Labels: set}
+	}
+
+	configs, err := macvtap.ParseNodeConfig(data, node)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "configuration is valid: %d resource(s)\n", len(configs))
+	if node != nil {
+		for _, cfg := range configs {
+			out, _ := json.Marshal(cfg)
+			fmt.Fprintln(stdout, string(out))
+		}
+	}
+	return 0
+}
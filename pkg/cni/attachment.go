@@ -0,0 +1,129 @@
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kubevirt/macvtap-cni/pkg/devinfo"
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+// AttachmentsDir is where the plugin records which host macvtap link was
+// handed over to which container attachment, so that GC can tell stale links
+// apart.
+var AttachmentsDir = "/var/lib/cni/macvtap"
+
+// attachment records the host macvtap link handed over to a container
+// interface by CmdAdd.
+type attachment struct {
+	// Network is the name of the network of the attachment, GC being
+	// invoked for each network with its own valid attachments only.
+	Network     string `json:"network"`
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+	DeviceID    string `json:"deviceID"`
+	// IfIndex is the host-side index of DeviceID at the time of the ADD. It
+	// tells apart a link that the device plugin has since recreated under
+	// the same name for a different pod.
+	IfIndex int `json:"ifindex"`
+}
+
+func attachmentPath(containerID, ifName string) string {
+	return filepath.Join(AttachmentsDir, fmt.Sprintf("%s-%s", containerID, ifName))
+}
+
+func saveAttachment(a attachment) error {
+	if err := os.MkdirAll(AttachmentsDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(attachmentPath(a.ContainerID, a.IfName), data, 0600)
+}
+
+// loadAttachment returns the recorded attachment, or nil if there is none.
+func loadAttachment(containerID, ifName string) (*attachment, error) {
+	data, err := os.ReadFile(attachmentPath(containerID, ifName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	a := &attachment{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func removeAttachment(containerID, ifName string) error {
+	err := os.Remove(attachmentPath(containerID, ifName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func listAttachments() ([]attachment, error) {
+	entries, err := os.ReadDir(AttachmentsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var attachments []attachment
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(AttachmentsDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var a attachment
+		if err := json.Unmarshal(data, &a); err != nil {
+			logger.Warningf("ignoring malformed attachment record %s: %v", entry.Name(), err)
+			continue
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+// cleanDeviceInfo removes the information the device plugin published for the
+// device of the attachment, unless the device has since been allocated again.
+func cleanDeviceInfo(a attachment) error {
+	resourceName := util.ResourceNameFromDevice(a.DeviceID)
+	if resourceName == "" {
+		return nil
+	}
+	info, err := devinfo.LoadForDP(resourceName, a.DeviceID)
+	if err != nil || info == nil || info.Tap == nil || info.Tap.IfIndex != a.IfIndex {
+		return err
+	}
+	return devinfo.CleanForDP(resourceName, a.DeviceID)
+}
+
+// recordPodInterface records, in the information the device plugin published
+// for a device, the netns and name of the pod interface it was moved to.
+func recordPodInterface(deviceID, netns, ifName string) error {
+	resourceName := util.ResourceNameFromDevice(deviceID)
+	if resourceName == "" {
+		return nil
+	}
+	info, err := devinfo.LoadForDP(resourceName, deviceID)
+	if err != nil || info == nil || info.Tap == nil {
+		return err
+	}
+	info.Tap.NetNS = netns
+	info.Tap.IfName = ifName
+	return devinfo.SaveForDP(resourceName, deviceID, info)
+}
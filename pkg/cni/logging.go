@@ -0,0 +1,240 @@
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+const (
+	// DefaultLogFile is where the plugin logs when no logFile is configured.
+	DefaultLogFile = "/opt/cni/bin/macvtap.log"
+	// DefaultLogMaxSize is the size in megabytes at which the log file is
+	// rotated when no logMaxSize is configured.
+	DefaultLogMaxSize = 10
+	// DefaultLogMaxBackups is the number of rotated log files kept when no
+	// logMaxBackups is configured.
+	DefaultLogMaxBackups = 3
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarning
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug:   "debug",
+	levelInfo:    "info",
+	levelWarning: "warning",
+	levelError:   "error",
+}
+
+func logLevelFromString(s string) (logLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug, nil
+	case "", "info":
+		return levelInfo, nil
+	case "warning", "warn":
+		return levelWarning, nil
+	case "error":
+		return levelError, nil
+	default:
+		return levelInfo, fmt.Errorf("unknown log level: %q", s)
+	}
+}
+
+// LogConf holds the logging settings of the plugin NetConf.
+type LogConf struct {
+	LogFile       string `json:"logFile,omitempty"`
+	LogLevel      string `json:"logLevel,omitempty"`
+	LogToStderr   bool   `json:"logToStderr,omitempty"`
+	LogMaxSize    int    `json:"logMaxSize,omitempty"`
+	LogMaxBackups int    `json:"logMaxBackups,omitempty"`
+}
+
+// cniLogger writes log entries as JSON lines carrying the context of the CNI
+// invocation.
+type cniLogger struct {
+	mu          sync.Mutex
+	out         io.Writer
+	level       logLevel
+	command     string
+	containerID string
+	netns       string
+	ifName      string
+}
+
+type logEntry struct {
+	Time        string `json:"time"`
+	Level       string `json:"level"`
+	Command     string `json:"command,omitempty"`
+	ContainerID string `json:"containerID,omitempty"`
+	Netns       string `json:"netns,omitempty"`
+	IfName      string `json:"ifname,omitempty"`
+	Msg         string `json:"msg"`
+}
+
+// logger is used until the NetConf has been read and setupLogging is called.
+var logger = &cniLogger{out: os.Stderr, level: levelError}
+
+// setupLogging replaces the package logger according to the given settings.
+// It never fails: an invalid level falls back to info, and a log file that
+// can not be opened falls back to stderr.
+func setupLogging(conf LogConf, command string, args *skel.CmdArgs) {
+	level, levelErr := logLevelFromString(conf.LogLevel)
+
+	l := &cniLogger{
+		level:   level,
+		command: command,
+	}
+	if args != nil {
+		l.containerID = args.ContainerID
+		l.netns = args.Netns
+		l.ifName = args.IfName
+	}
+
+	var fileErr error
+	if conf.LogToStderr {
+		l.out = os.Stderr
+	} else {
+		logFile := conf.LogFile
+		if logFile == "" {
+			logFile = DefaultLogFile
+		}
+		maxSize := conf.LogMaxSize
+		if maxSize <= 0 {
+			maxSize = DefaultLogMaxSize
+		}
+		maxBackups := conf.LogMaxBackups
+		if maxBackups <= 0 {
+			maxBackups = DefaultLogMaxBackups
+		}
+		var file *rotatingFile
+		file, fileErr = openRotatingFile(logFile, int64(maxSize)*1024*1024, maxBackups)
+		if fileErr != nil {
+			l.out = os.Stderr
+		} else {
+			l.out = file
+		}
+	}
+
+	if previous, ok := logger.out.(*rotatingFile); ok {
+		previous.file.Close()
+	}
+	logger = l
+	if levelErr != nil {
+		logger.Warningf("%v, using info", levelErr)
+	}
+	if fileErr != nil {
+		logger.Warningf("failed to open log file, logging to stderr: %v", fileErr)
+	}
+}
+
+func (l *cniLogger) log(level logLevel, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	line, err := json.Marshal(logEntry{
+		Time:        time.Now().Format(time.RFC3339Nano),
+		Level:       logLevelNames[level],
+		Command:     l.command,
+		ContainerID: l.containerID,
+		Netns:       l.netns,
+		IfName:      l.ifName,
+		Msg:         fmt.Sprintf(format, args...),
+	})
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(append(line, '\n'))
+}
+
+func (l *cniLogger) Debugf(format string, args ...interface{}) {
+	l.log(levelDebug, format, args...)
+}
+
+func (l *cniLogger) Infof(format string, args ...interface{}) {
+	l.log(levelInfo, format, args...)
+}
+
+func (l *cniLogger) Warningf(format string, args ...interface{}) {
+	l.log(levelWarning, format, args...)
+}
+
+func (l *cniLogger) Errorf(format string, args ...interface{}) {
+	l.log(levelError, format, args...)
+}
+
+// rotatingFile is an io.Writer to a file that is rotated once it would grow
+// past maxSize bytes. Rotated files are suffixed with .1 (most recent) up to
+// .<maxBackups>.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	_ = r.file.Close()
+	for i := r.maxBackups - 1; i > 0; i-- {
+		// Missing backups are expected until maxBackups rotations happened
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	// On a failed rename the current file keeps growing rather than losing
+	// log entries
+	_ = os.Rename(r.path, r.path+".1")
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
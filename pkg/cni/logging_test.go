@@ -0,0 +1,101 @@
+package cni
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logging", func() {
+	var logDir string
+	var args *skel.CmdArgs
+
+	readEntries := func(path string) []logEntry {
+		file, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+
+		var entries []logEntry
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry logEntry
+			Expect(json.Unmarshal(scanner.Bytes(), &entry)).To(Succeed())
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	BeforeEach(func() {
+		var err error
+		logDir, err = os.MkdirTemp("", "macvtap-log")
+		Expect(err).NotTo(HaveOccurred())
+
+		args = &skel.CmdArgs{
+			ContainerID: "container",
+			Netns:       "/var/run/netns/test",
+			IfName:      "net1",
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(logDir)).To(Succeed())
+	})
+
+	It("SHOULD write JSON lines carrying the invocation context", func() {
+		logFile := filepath.Join(logDir, "macvtap.log")
+		setupLogging(LogConf{LogFile: logFile}, "ADD", args)
+		logger.Infof("hello %s", "world")
+
+		entries := readEntries(logFile)
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Level).To(Equal("info"))
+		Expect(entries[0].Command).To(Equal("ADD"))
+		Expect(entries[0].ContainerID).To(Equal("container"))
+		Expect(entries[0].Netns).To(Equal("/var/run/netns/test"))
+		Expect(entries[0].IfName).To(Equal("net1"))
+		Expect(entries[0].Msg).To(Equal("hello world"))
+	})
+
+	It("SHOULD only log entries at or above the configured level", func() {
+		logFile := filepath.Join(logDir, "macvtap.log")
+		setupLogging(LogConf{LogFile: logFile, LogLevel: "warning"}, "DEL", args)
+		logger.Debugf("debug")
+		logger.Infof("info")
+		logger.Warningf("warning")
+		logger.Errorf("error")
+
+		entries := readEntries(logFile)
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Msg).To(Equal("warning"))
+		Expect(entries[1].Msg).To(Equal("error"))
+	})
+
+	It("SHOULD fall back to stderr when the log file can not be opened", func() {
+		Expect(func() {
+			setupLogging(LogConf{LogFile: filepath.Join(logDir, "missing", "macvtap.log")}, "ADD", args)
+		}).NotTo(Panic())
+		Expect(logger.out).To(Equal(os.Stderr))
+	})
+
+	It("SHOULD rotate the log file once it grows past its maximum size", func() {
+		logFile := filepath.Join(logDir, "macvtap.log")
+		file, err := openRotatingFile(logFile, 10, 2)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+			_, err = file.Write([]byte(line))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(file.file.Close()).To(Succeed())
+
+		Expect(os.ReadFile(logFile)).To(BeEquivalentTo("fourth\n"))
+		Expect(os.ReadFile(logFile + ".1")).To(BeEquivalentTo("third\n"))
+		Expect(os.ReadFile(logFile + ".2")).To(BeEquivalentTo("second\n"))
+		Expect(logFile + ".3").NotTo(BeAnExistingFile())
+	})
+})
@@ -15,21 +15,24 @@
 package cni
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
-	"os"
 	"reflect"
 	"runtime"
+	"strings"
 
+	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/kubevirt/macvtap-cni/pkg/devinfo"
 	"github.com/kubevirt/macvtap-cni/pkg/util"
 )
 
@@ -37,12 +40,27 @@ import (
 type NetConf struct {
 	types.NetConf
 	DeviceID      string `json:"deviceID"`
+	Master        string `json:"master,omitempty"`
+	Mode          string `json:"mode,omitempty"`
 	MTU           int    `json:"mtu,omitempty"`
 	IsPromiscuous bool   `json:"promiscMode,omitempty"`
 	Mac           string `json:"mac,omitempty"`
+	Queues        int    `json:"queues,omitempty"`
+	LogConf
+
+	// SourceMACs are accepted by a macvtap in source mode, besides the MAC
+	// address of the macvtap itself.
+	SourceMACs []string `json:"sourceMacs,omitempty"`
+
+	// AllowedLowerDevices optionally restricts the parents of the devices
+	// that may be moved into the container.
+	AllowedLowerDevices []string `json:"allowedLowerDevices,omitempty"`
 
 	RuntimeConfig struct {
 		Mac string `json:"mac,omitempty"`
+		// CNIDeviceInfoFile is where the runtime, typically Multus, expects
+		// the plugin to write the information of the device.
+		CNIDeviceInfoFile string `json:"CNIDeviceInfoFile,omitempty"`
 	} `json:"runtimeConfig,omitempty"`
 }
 
@@ -52,14 +70,13 @@ type EnvArgs struct {
 	MAC types.UnmarshallableString `json:"mac,omitempty"`
 }
 
-var logger *log.Logger
+// Error codes defined by the CNI spec for STATUS that are not provided by the
+// types package.
+const (
+	errPluginNotAvailable uint = 50
+)
 
 func init() {
-	logFile, err := os.OpenFile("/opt/cni/bin/macvtap.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		log.Panic("Initialization log file error", err)
-	}
-	logger = log.New(logFile, "[macvtap]", log.Ldate|log.Ltime|log.Lshortfile)
 	// this ensures that main runs only on main thread (thread group leader).
 	// since namespace ops (unshare, setns) are done for a single thread, we
 	// must ensure that the goroutine does not jump from OS thread to thread
@@ -97,15 +114,6 @@ func getEnvArgs(envArgsString string) (EnvArgs, error) {
 
 // CmdAdd - CNI interface
 func CmdAdd(args *skel.CmdArgs) error {
-	logger.Println("CmdAdd")
-	logger.Println(
-		"ContainerID: ", args.ContainerID,
-		"Netns: ", args.Netns,
-		"IfName: ", args.IfName,
-		"Args: ", args.Args,
-		"Path: ", args.Path,
-		"StdinData: ", string(args.StdinData))
-
 	var (
 		netConf    *NetConf
 		cniVersion string
@@ -114,11 +122,27 @@ func CmdAdd(args *skel.CmdArgs) error {
 	)
 	netConf, cniVersion, err = loadConf(args.StdinData, args.Args)
 	if err != nil {
+		logger.Errorf("failed to load netconf: %v", err)
 		return err
 	}
+	setupLogging(netConf.LogConf, "ADD", args)
+	logger.Debugf("args: %q, path: %q, stdin: %s", args.Args, args.Path, args.StdinData)
+
+	// Without a deviceID from the device plugin, the plugin runs standalone
+	// and creates the macvtap on top of master by itself.
+	isStandalone := netConf.DeviceID == ""
+	if isStandalone && netConf.Master == "" {
+		return types.NewError(types.ErrInvalidNetworkConfig, "either deviceID or master must be set", "")
+	}
 
-	netConfBytes, _ := json.Marshal(netConf)
-	logger.Println("Add NetConf: ", string(netConfBytes))
+	// Refuse to move anything but a device plugin macvtap into the container,
+	// as a wrong deviceID could otherwise take a link away from the host.
+	if !isStandalone {
+		if err = util.ValidateDevice(netConf.DeviceID, netConf.AllowedLowerDevices); err != nil {
+			logger.Errorf("%v", err)
+			return types.NewError(types.ErrInvalidNetworkConfig, fmt.Sprintf("refusing to move device %q", netConf.DeviceID), err.Error())
+		}
+	}
 
 	if netConf.Mac != "" {
 		aMac, err := net.ParseMAC(netConf.Mac)
@@ -145,23 +169,23 @@ func CmdAdd(args *skel.CmdArgs) error {
 	)
 
 	if isLayer3 {
-		logger.Println("Need ", netConf.IPAM.Type, " IPAM to allocate address")
+		logger.Infof("need %s IPAM to allocate address", netConf.IPAM.Type)
 
 		ipamResult, err := util.ExecIPAMAdd(netConf.IPAM.Type, args.StdinData)
 		if err != nil {
-			logger.Println(err)
+			logger.Errorf("%v", err)
 			return err
 		}
 
 		ipamBytes, _ := json.Marshal(ipamResult)
-		logger.Println("ipamResult: ", string(ipamBytes))
+		logger.Infof("IPAM result: %s", ipamBytes)
 
 		// Prioritize using the MAC address distributed by IPAM
 		for _, iface := range ipamResult.Interfaces {
 			if iface != nil && len(iface.Mac) > 0 {
 				macAddr, err := net.ParseMAC(iface.Mac)
 				if err != nil {
-					logger.Println("failed to parse mac address: ", err.Error())
+					logger.Warningf("failed to parse mac address: %v", err)
 					continue
 				}
 				mac = &macAddr
@@ -193,17 +217,67 @@ func CmdAdd(args *skel.CmdArgs) error {
 				return util.LinkDelete(args.IfName)
 			})
 			util.LinkDelete(netConf.DeviceID)
+			removeAttachment(args.ContainerID, args.IfName)
 		}
 	}()
 
+	if isStandalone {
+		netConf.DeviceID = util.TemporaryMacvtapName()
+		logger.Infof("create macvtap link %s on master %s with mode %q", netConf.DeviceID, netConf.Master, netConf.Mode)
+		if _, err = util.CreateMacvtap(netConf.DeviceID, netConf.Master, netConf.Mode, netConf.Queues); err != nil {
+			logger.Errorf("%v", err)
+			return err
+		}
+	}
+
+	queues, err := util.LinkQueues(netConf.DeviceID)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return err
+	}
+	if netConf.Queues > 1 && queues < netConf.Queues {
+		err = fmt.Errorf("device %q has %d queues, %d requested", netConf.DeviceID, queues, netConf.Queues)
+		logger.Errorf("%v", err)
+		return err
+	}
+	logger.Infof("macvtap link %s has %d queues", netConf.DeviceID, queues)
+
+	if ifIndex, indexErr := util.LinkIndexByName(netConf.DeviceID); indexErr == nil {
+		recordErr := saveAttachment(attachment{
+			Network:     netConf.Name,
+			ContainerID: args.ContainerID,
+			IfName:      args.IfName,
+			DeviceID:    netConf.DeviceID,
+			IfIndex:     ifIndex,
+		})
+		if recordErr != nil {
+			logger.Warningf("failed to record attachment: %v", recordErr)
+		}
+	}
+
 	macvtapInterface, err = util.ConfigureInterface(netConf.DeviceID, args.IfName, mac, netConf.MTU, netConf.IsPromiscuous, netns)
 	if err != nil {
-		logger.Println(err)
+		logger.Errorf("%v", err)
 		return err
 	}
 
 	result.Interfaces = []*current.Interface{macvtapInterface}
 
+	if err = setSourceMACs(netConf, macvtapInterface, netns); err != nil {
+		logger.Errorf("%v", err)
+		return err
+	}
+
+	if publishErr := publishDeviceInfo(netConf, isStandalone, args.IfName, netns); publishErr != nil {
+		logger.Warningf("failed to publish device info: %v", publishErr)
+	}
+
+	if !isStandalone {
+		if recordErr := recordPodInterface(netConf.DeviceID, args.Netns, args.IfName); recordErr != nil {
+			logger.Warningf("failed to record the pod interface of device %s: %v", netConf.DeviceID, recordErr)
+		}
+	}
+
 	if isLayer3 {
 		setIPAMResultErr := netns.Do(func(_ ns.NetNS) error {
 			_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/arp_notify", args.IfName), "1")
@@ -212,45 +286,119 @@ func CmdAdd(args *skel.CmdArgs) error {
 			return ipam.ConfigureIface(args.IfName, result)
 		})
 		if setIPAMResultErr != nil {
-			logger.Println("Configure IPAM result error: ", setIPAMResultErr.Error())
+			logger.Errorf("failed to configure IPAM result: %v", setIPAMResultErr)
 		}
 	}
 
 	rs, _ := json.Marshal(result)
-	logger.Println("CmdAdd result: ", string(rs))
+	logger.Infof("result: %s", rs)
 
 	return types.PrintResult(result, cniVersion)
 }
 
+// setSourceMACs allows the MAC address of the interface and the configured
+// source MAC addresses on a macvtap in source mode. Other modes are left as is.
+func setSourceMACs(netConf *NetConf, iface *current.Interface, netns ns.NetNS) error {
+	var macs []net.HardwareAddr
+	for _, s := range append([]string{iface.Mac}, netConf.SourceMACs...) {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return fmt.Errorf("failed to parse source MAC address %q: %v", s, err)
+		}
+		macs = append(macs, mac)
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		isSource, err := util.SetSourceMACs(iface.Name, macs)
+		if isSource && err == nil {
+			logger.Infof("allowed source MAC addresses %v on %s", macs, iface.Name)
+		}
+		return err
+	})
+}
+
+// publishDeviceInfo writes the information of the device to the file requested
+// by the runtime, if any. The information published by the device plugin for
+// the device is used, or, standalone, information about the created macvtap.
+func publishDeviceInfo(netConf *NetConf, isStandalone bool, ifName string, netns ns.NetNS) error {
+	if netConf.RuntimeConfig.CNIDeviceInfoFile == "" {
+		return nil
+	}
+
+	var (
+		info *devinfo.DeviceInfo
+		err  error
+	)
+	if isStandalone {
+		var index int
+		err = netns.Do(func(_ ns.NetNS) error {
+			var err error
+			index, err = util.LinkIndexByName(ifName)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		info = &devinfo.DeviceInfo{
+			Type:    util.TypeMacvtap,
+			Version: devinfo.Version,
+			Tap: &devinfo.TapDevice{
+				Path:        fmt.Sprintf("/dev/tap%d", index),
+				IfIndex:     index,
+				LowerDevice: netConf.Master,
+				Mode:        netConf.Mode,
+				Queues:      netConf.Queues,
+			},
+		}
+	} else {
+		info, err = devinfo.LoadForDP(util.ResourceNameFromDevice(netConf.DeviceID), netConf.DeviceID)
+		if err != nil || info == nil {
+			return err
+		}
+	}
+
+	logger.Infof("publish device info to %s", netConf.RuntimeConfig.CNIDeviceInfoFile)
+	return devinfo.SaveToFile(netConf.RuntimeConfig.CNIDeviceInfoFile, info)
+}
+
 // CmdDel - CNI plugin Interface
 func CmdDel(args *skel.CmdArgs) error {
-	logger.Println("CmdDel")
-	logger.Println(
-		"ContainerID: ", args.ContainerID,
-		"Netns: ", args.Netns,
-		"IfName: ", args.IfName,
-		"Args: ", args.Args,
-		"Path: ", args.Path,
-		"StdinData: ", string(args.StdinData))
-
 	netConf, _, err := loadConf(args.StdinData, args.Args)
 	if err != nil {
+		logger.Errorf("failed to load netconf: %v", err)
 		return err
 	}
-
-	netConfBytes, _ := json.Marshal(netConf)
-	logger.Println("Del NetConf: ", string(netConfBytes))
+	setupLogging(netConf.LogConf, "DEL", args)
+	logger.Debugf("args: %q, path: %q, stdin: %s", args.Args, args.Path, args.StdinData)
 
 	isLayer3 := netConf.IPAM.Type != ""
 
 	if isLayer3 {
 		err = ipam.ExecDel(netConf.IPAM.Type, args.StdinData)
 		if err != nil {
-			logger.Println("Exec IPAM delete error: ", err.Error())
+			logger.Errorf("failed to exec IPAM delete: %v", err)
 			return err
 		}
 	}
 
+	if netConf.RuntimeConfig.CNIDeviceInfoFile != "" {
+		if err = devinfo.CleanFile(netConf.RuntimeConfig.CNIDeviceInfoFile); err != nil {
+			logger.Warningf("failed to remove device info: %v", err)
+		}
+	}
+
+	if a, loadErr := loadAttachment(args.ContainerID, args.IfName); loadErr != nil {
+		logger.Warningf("failed to load attachment record: %v", loadErr)
+	} else if a != nil {
+		if err = cleanDeviceInfo(*a); err != nil {
+			logger.Warningf("failed to remove device plugin device info: %v", err)
+		}
+	}
+
+	if err = removeAttachment(args.ContainerID, args.IfName); err != nil {
+		logger.Warningf("failed to remove attachment record: %v", err)
+	}
+
 	if args.Netns == "" {
 		return nil
 	}
@@ -265,12 +413,233 @@ func CmdDel(args *skel.CmdArgs) error {
 		return nil
 	})
 	if err != nil {
-		logger.Println("Delete netns ", args.Netns, " macvtap link ", args.IfName, " error: ", err.Error())
+		logger.Errorf("failed to delete macvtap link: %v", err)
 	}
 	return err
 }
 
 // CmdCheck - CNI plugin Interface
 func CmdCheck(args *skel.CmdArgs) error {
+	netConf, _, err := loadConf(args.StdinData, args.Args)
+	if err != nil {
+		logger.Errorf("failed to load netconf: %v", err)
+		return err
+	}
+	setupLogging(netConf.LogConf, "CHECK", args)
+	logger.Debugf("args: %q, path: %q, stdin: %s", args.Args, args.Path, args.StdinData)
+
+	if netConf.RawPrevResult == nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "required prevResult missing", "")
+	}
+	if err = version.ParsePrevResult(&netConf.NetConf); err != nil {
+		return types.NewError(types.ErrDecodingFailure, "failed to parse prevResult", err.Error())
+	}
+	result, err := current.NewResultFromResult(netConf.PrevResult)
+	if err != nil {
+		return types.NewError(types.ErrDecodingFailure, "failed to convert prevResult", err.Error())
+	}
+
+	var containerIface *current.Interface
+	for _, iface := range result.Interfaces {
+		if iface != nil && iface.Name == args.IfName && iface.Sandbox == args.Netns {
+			containerIface = iface
+			break
+		}
+	}
+	if containerIface == nil {
+		return types.NewError(types.ErrInternal,
+			fmt.Sprintf("interface %q in netns %q not found in prevResult", args.IfName, args.Netns), "")
+	}
+
+	isLayer3 := netConf.IPAM.Type != ""
+	if isLayer3 {
+		if err = ipam.ExecCheck(netConf.IPAM.Type, args.StdinData); err != nil {
+			logger.Errorf("failed to exec IPAM check: %v", err)
+			return err
+		}
+	}
+
+	// The expected parent is looked up in the current (host) netns, as the
+	// parent index of the macvtap inside the container refers to it.
+	expectedParentIndex := 0
+	if netConf.Master != "" {
+		parentIndex, err := util.LinkIndexByName(netConf.Master)
+		if err != nil {
+			return types.NewError(types.ErrInternal, fmt.Sprintf("failed to lookup master %q", netConf.Master), err.Error())
+		}
+		expectedParentIndex = parentIndex
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	var parentIndex int
+	err = netns.Do(func(_ ns.NetNS) error {
+		link, err := util.ValidateInterface(args.IfName, expectedParentIndex, containerIface.Mac, netConf.MTU, netConf.IsPromiscuous)
+		if err != nil {
+			return err
+		}
+		parentIndex = link.Attrs().ParentIndex
+
+		if err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs); err != nil {
+			return err
+		}
+		return ip.ValidateExpectedRoute(result.Routes)
+	})
+	if err != nil {
+		logger.Errorf("interface check failed: %v", err)
+		return types.NewError(types.ErrInternal, fmt.Sprintf("interface %q check failed", args.IfName), err.Error())
+	}
+
+	if expectedParentIndex == 0 {
+		lowerDevice, err := util.LinkNameByIndex(parentIndex)
+		if err != nil {
+			logger.Errorf("interface lower device check failed: %v", err)
+			return types.NewError(types.ErrInternal, fmt.Sprintf("lower device of interface %q not found", args.IfName), err.Error())
+		}
+		if err = checkLowerDevice(netConf, lowerDevice); err != nil {
+			logger.Errorf("interface lower device check failed: %v", err)
+			return types.NewError(types.ErrInternal, fmt.Sprintf("interface %q has an unexpected lower device", args.IfName), err.Error())
+		}
+	}
+
+	return nil
+}
+
+// checkLowerDevice checks that the lower device of a device plugin macvtap is
+// the one the device plugin created it on, as published in its device info,
+// and one of the allowed lower devices, if any.
+func checkLowerDevice(netConf *NetConf, lowerDevice string) error {
+	info, err := devinfo.LoadForDP(util.ResourceNameFromDevice(netConf.DeviceID), netConf.DeviceID)
+	if err != nil {
+		return err
+	}
+	if info != nil && info.Tap != nil && info.Tap.LowerDevice != "" && info.Tap.LowerDevice != lowerDevice {
+		return fmt.Errorf("lower device is %q, expected %q", lowerDevice, info.Tap.LowerDevice)
+	}
+
+	if len(netConf.AllowedLowerDevices) == 0 {
+		return nil
+	}
+	for _, allowed := range netConf.AllowedLowerDevices {
+		if lowerDevice == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("lower device %q is not an allowed lower device %v", lowerDevice, netConf.AllowedLowerDevices)
+}
+
+// CmdGC - CNI plugin Interface
+// Attachments recorded by CmdAdd that are not in the list of valid attachments
+// are released: their host macvtap link is deleted if it was left behind in
+// the host netns, and IPAM is asked to garbage collect its allocations.
+func CmdGC(args *skel.CmdArgs) error {
+	netConf, _, err := loadConf(args.StdinData, args.Args)
+	if err != nil {
+		logger.Errorf("failed to load netconf: %v", err)
+		return err
+	}
+	setupLogging(netConf.LogConf, "GC", args)
+	logger.Debugf("args: %q, path: %q, stdin: %s", args.Args, args.Path, args.StdinData)
+
+	valid := make(map[types.GCAttachment]bool, len(netConf.ValidAttachments))
+	for _, a := range netConf.ValidAttachments {
+		valid[a] = true
+	}
+
+	attachments, err := listAttachments()
+	if err != nil {
+		return types.NewError(types.ErrIOFailure, "failed to list attachments", err.Error())
+	}
+
+	var errs []string
+	for _, a := range attachments {
+		// The valid attachments are those of the invoked network only
+		if a.Network != netConf.Name {
+			continue
+		}
+		if valid[types.GCAttachment{ContainerID: a.ContainerID, IfName: a.IfName}] {
+			continue
+		}
+		if strings.Contains(a.DeviceID, util.DeviceNameInfix) {
+			deleted, err := util.DeleteMacvtapWithIndex(a.DeviceID, a.IfIndex)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("failed to delete stale link %q: %v", a.DeviceID, err))
+				continue
+			}
+			if deleted {
+				logger.Infof("deleted stale macvtap link %s of container %s", a.DeviceID, a.ContainerID)
+			}
+		}
+		if err := cleanDeviceInfo(a); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to remove device info of %q: %v", a.DeviceID, err))
+		}
+		if err := removeAttachment(a.ContainerID, a.IfName); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if netConf.IPAM.Type != "" {
+		if err := invoke.DelegateGC(context.TODO(), netConf.IPAM.Type, args.StdinData, nil); err != nil {
+			logger.Errorf("failed to exec IPAM GC: %v", err)
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return types.NewError(types.ErrInternal, "garbage collection failed", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// CmdStatus - CNI plugin Interface
+// The plugin is reported as not available when the kernel has no macvtap
+// support, or when there is no usable lower device: the configured master if
+// any, or otherwise any suitable macvtap parent.
+func CmdStatus(args *skel.CmdArgs) error {
+	netConf, _, err := loadConf(args.StdinData, args.Args)
+	if err != nil {
+		logger.Errorf("failed to load netconf: %v", err)
+		return err
+	}
+	setupLogging(netConf.LogConf, "STATUS", args)
+	logger.Debugf("args: %q, path: %q, stdin: %s", args.Args, args.Path, args.StdinData)
+
+	supported, err := util.MacvtapSupported()
+	if err != nil {
+		return types.NewError(errPluginNotAvailable, "failed to check for macvtap support", err.Error())
+	}
+	if !supported {
+		return types.NewError(errPluginNotAvailable, "macvtap is not supported by the kernel", "")
+	}
+
+	if netConf.Master != "" {
+		exists, err := util.LinkExists(netConf.Master)
+		if err != nil || !exists {
+			details := ""
+			if err != nil {
+				details = err.Error()
+			}
+			return types.NewError(errPluginNotAvailable, fmt.Sprintf("master %q not found", netConf.Master), details)
+		}
+	} else {
+		parents, err := util.FindSuitableMacvtapParents()
+		if err != nil {
+			return types.NewError(errPluginNotAvailable, "failed to list lower devices", err.Error())
+		}
+		if len(parents) == 0 {
+			return types.NewError(errPluginNotAvailable, "no suitable lower device found", "")
+		}
+	}
+
+	if netConf.IPAM.Type != "" {
+		if err := ipam.ExecStatus(netConf.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
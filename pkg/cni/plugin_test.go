@@ -2,11 +2,16 @@ package cni_test
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 
 	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
 	"github.com/kubevirt/macvtap-cni/pkg/cni"
+	"github.com/kubevirt/macvtap-cni/pkg/devinfo"
 	"github.com/kubevirt/macvtap-cni/pkg/util"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -23,7 +28,7 @@ var _ = Describe("Macvtap CNI", func() {
 		var macvtapInterface netlink.Link
 		var stdInArgs string
 
-		deviceID := "dev500"
+		deviceID := "devMvp500"
 		macvtapIfaceName := "macvtap0"
 
 		BeforeEach(func() {
@@ -49,7 +54,7 @@ var _ = Describe("Macvtap CNI", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				// create macvtap on top of lower device
-				_, err = util.CreateMacvtap(deviceID, LOWER_DEVICE, "bridge")
+				_, err = util.CreateMacvtap(deviceID, LOWER_DEVICE, "bridge", 0)
 				Expect(err).NotTo(HaveOccurred())
 
 				// cache the macvtap interface
@@ -252,5 +257,444 @@ var _ = Describe("Macvtap CNI", func() {
 				})
 			})
 		})
+
+		When("checking an imported macvtap interface", func() {
+			var args *skel.CmdArgs
+			var checkConf string
+
+			BeforeEach(func() {
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(stdInArgs),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, out, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					checkConf = fmt.Sprintf(`{
+					"cniVersion": "0.4.0",
+					"name": "mynet",
+					"type": "macvtap",
+					"deviceID": "%s",
+					"master": "%s",
+					"prevResult": %s
+				}`, deviceID, LOWER_DEVICE, out)
+
+					return nil
+				})
+			})
+
+			It("SHOULD succeed while the interface matches the previous result", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					args.StdinData = []byte(checkConf)
+					err := testutils.CmdCheckWithArgs(args, func() error { return cni.CmdCheck(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD fail once the interface MAC address drifted", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					mac, err := net.ParseMAC("0a:59:00:dc:6a:e1")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(netlink.LinkSetHardwareAddr(link, mac)).To(Succeed())
+
+					return nil
+				})
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					args.StdinData = []byte(checkConf)
+					err := testutils.CmdCheckWithArgs(args, func() error { return cni.CmdCheck(args) })
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("MAC address"))
+
+					return nil
+				})
+			})
+
+			It("SHOULD fail once the interface became promiscuous", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(netlink.SetPromiscOn(link)).To(Succeed())
+
+					return nil
+				})
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					args.StdinData = []byte(checkConf)
+					err := testutils.CmdCheckWithArgs(args, func() error { return cni.CmdCheck(args) })
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("promiscuous mode on, expected off"))
+
+					return nil
+				})
+			})
+		})
+
+		When("checking a device plugin macvtap interface", func() {
+			var args *skel.CmdArgs
+			var prevResult []byte
+			var originalDPDir string
+
+			publishLowerDevice := func(lowerDevice string) {
+				Expect(devinfo.SaveForDP(util.ResourceNameFromDevice(deviceID), deviceID, &devinfo.DeviceInfo{
+					Type:    util.TypeMacvtap,
+					Version: devinfo.Version,
+					Tap:     &devinfo.TapDevice{LowerDevice: lowerDevice},
+				})).To(Succeed())
+			}
+
+			check := func(allowedLowerDevices string) error {
+				var err error
+				originalNS.Do(func(ns.NetNS) error {
+					args.StdinData = []byte(fmt.Sprintf(`{
+					"cniVersion": "0.4.0",
+					"name": "mynet",
+					"type": "macvtap",
+					"deviceID": "%s",
+					"allowedLowerDevices": %s,
+					"prevResult": %s
+				}`, deviceID, allowedLowerDevices, prevResult))
+					err = testutils.CmdCheckWithArgs(args, func() error { return cni.CmdCheck(args) })
+					return nil
+				})
+				return err
+			}
+
+			BeforeEach(func() {
+				originalDPDir = devinfo.DPDir
+				dpDir, err := os.MkdirTemp("", "devinfo")
+				Expect(err).NotTo(HaveOccurred())
+				devinfo.DPDir = dpDir
+				publishLowerDevice(LOWER_DEVICE)
+
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(stdInArgs),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, out, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+					prevResult = out
+
+					return nil
+				})
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(devinfo.DPDir)).To(Succeed())
+				devinfo.DPDir = originalDPDir
+			})
+
+			It("SHOULD succeed while the parent is the lower device it was created on", func() {
+				Expect(check(fmt.Sprintf(`["%s"]`, LOWER_DEVICE))).To(Succeed())
+			})
+
+			It("SHOULD fail once the parent is not the lower device it was created on", func() {
+				publishLowerDevice("eth1")
+
+				err := check("[]")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(`lower device is "eth0", expected "eth1"`))
+			})
+
+			It("SHOULD fail when the parent is not an allowed lower device", func() {
+				err := check(`["eth1"]`)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("not an allowed lower device"))
+			})
+		})
+
+		When("garbage collecting attachments", func() {
+			var args *skel.CmdArgs
+			var attachmentsDir string
+
+			gcConfFor := func(network, validAttachments string) []byte {
+				return []byte(fmt.Sprintf(`{
+				"cniVersion": "1.1.0",
+				"name": "%s",
+				"type": "macvtap",
+				"cni.dev/valid-attachments": %s
+			}`, network, validAttachments))
+			}
+			gcConf := func(validAttachments string) []byte {
+				return gcConfFor("mynet", validAttachments)
+			}
+
+			BeforeEach(func() {
+				var err error
+				attachmentsDir, err = os.MkdirTemp("", "macvtap-attachments")
+				Expect(err).NotTo(HaveOccurred())
+				cni.AttachmentsDir = attachmentsDir
+
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(stdInArgs),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+				Expect(filepath.Join(attachmentsDir, "dummy-"+macvtapIfaceName)).To(BeAnExistingFile())
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(attachmentsDir)).To(Succeed())
+			})
+
+			It("SHOULD keep the attachments that are still valid", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					args.StdinData = gcConf(fmt.Sprintf(`[{"containerID": "dummy", "ifname": "%s"}]`, macvtapIfaceName))
+					Expect(cni.CmdGC(args)).To(Succeed())
+
+					return nil
+				})
+				Expect(filepath.Join(attachmentsDir, "dummy-"+macvtapIfaceName)).To(BeAnExistingFile())
+			})
+
+			It("SHOULD release the attachments that are no longer valid", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					args.StdinData = gcConf("[]")
+					Expect(cni.CmdGC(args)).To(Succeed())
+
+					return nil
+				})
+				Expect(filepath.Join(attachmentsDir, "dummy-"+macvtapIfaceName)).NotTo(BeAnExistingFile())
+			})
+
+			It("SHOULD keep the attachments of other networks", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					args.StdinData = gcConfFor("othernet", "[]")
+					Expect(cni.CmdGC(args)).To(Succeed())
+
+					return nil
+				})
+				Expect(filepath.Join(attachmentsDir, "dummy-"+macvtapIfaceName)).To(BeAnExistingFile())
+			})
+		})
+
+		When("querying the plugin status", func() {
+			It("SHOULD report not available if the master does not exist", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					args := &skel.CmdArgs{
+						StdinData: []byte(`{
+						"cniVersion": "1.1.0",
+						"name": "mynet",
+						"type": "macvtap",
+						"master": "missing0"
+					}`),
+					}
+					err := cni.CmdStatus(args)
+					Expect(err).To(HaveOccurred())
+					Expect(err.(*types.Error).Code).To(BeEquivalentTo(50))
+
+					return nil
+				})
+			})
+		})
+
+		When("no deviceID is given and a master is configured", func() {
+			var args *skel.CmdArgs
+
+			BeforeEach(func() {
+				standaloneArgs := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"master": "%s",
+				"mode": "vepa"
+			}`, LOWER_DEVICE)
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(standaloneArgs),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD create a macvtap interface on top of master in the target netns", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.Type()).To(Equal("macvtap"))
+					Expect(link.(*netlink.Macvtap).Mode).To(Equal(netlink.MACVLAN_MODE_VEPA))
+					Expect(link.Attrs().ParentIndex).To(Equal(lowerDevice.Attrs().Index))
+
+					return nil
+				})
+			})
+
+			It("SHOULD delete the macvtap interface, once requested via CmdDel", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).To(HaveOccurred())
+
+					return nil
+				})
+			})
+		})
+
+		When("the deviceID names a link that is not a device plugin macvtap", func() {
+			It("SHOULD refuse to move it into the target netns", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					args := &skel.CmdArgs{
+						ContainerID: "dummy",
+						Netns:       targetNs.Path(),
+						IfName:      macvtapIfaceName,
+						StdinData: []byte(fmt.Sprintf(`{
+						"cniVersion": "0.3.1",
+						"name": "mynet",
+						"type": "macvtap",
+						"deviceID": "%s"
+					}`, LOWER_DEVICE)),
+					}
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).To(HaveOccurred())
+
+					_, err = netlink.LinkByName(LOWER_DEVICE)
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD refuse to move a macvtap whose parent is not allowed", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					args := &skel.CmdArgs{
+						ContainerID: "dummy",
+						Netns:       targetNs.Path(),
+						IfName:      macvtapIfaceName,
+						StdinData: []byte(fmt.Sprintf(`{
+						"cniVersion": "0.3.1",
+						"name": "mynet",
+						"type": "macvtap",
+						"deviceID": "%s",
+						"allowedLowerDevices": ["eth1"]
+					}`, deviceID)),
+					}
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).To(HaveOccurred())
+
+					_, err = netlink.LinkByName(deviceID)
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+		})
+
+		When("the macvtap interface is in source mode", func() {
+			const extraMac = "0a:59:00:dc:6a:e2"
+
+			BeforeEach(func() {
+				sourceArgs := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"master": "%s",
+				"mode": "source",
+				"sourceMacs": ["%s"]
+			}`, LOWER_DEVICE, extraMac)
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(sourceArgs),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD allow its own and the configured source MAC addresses", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					macvtap := link.(*netlink.Macvtap)
+					Expect(macvtap.Mode).To(Equal(netlink.MACVLAN_MODE_SOURCE))
+
+					var macs []string
+					for _, mac := range macvtap.MACAddrs {
+						macs = append(macs, mac.String())
+					}
+					Expect(macs).To(ConsistOf(link.Attrs().HardwareAddr.String(), extraMac))
+
+					return nil
+				})
+			})
+		})
 	})
 })
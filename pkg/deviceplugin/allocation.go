@@ -0,0 +1,163 @@
+package deviceplugin
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AllocationPolicyLowestIndex prefers the devices with the lowest index,
+	// so that <name>Mvp2 goes before <name>Mvp10. It is the default.
+	AllocationPolicyLowestIndex = "lowest-index"
+	// AllocationPolicyLeastRecentlyUsed prefers the devices that were
+	// allocated the longest time ago, or never.
+	AllocationPolicyLeastRecentlyUsed = "least-recently-used"
+	// AllocationPolicyRandom prefers devices at random.
+	AllocationPolicyRandom = "random"
+)
+
+// AllocationPolicy chooses the devices the kubelet should allocate to a
+// container out of the available ones.
+type AllocationPolicy interface {
+	// Preferred returns size device IDs out of available, including every
+	// device of mustInclude. It returns fewer only if there are not enough
+	// available devices.
+	Preferred(available, mustInclude []string, size int) []string
+	// Allocated records the devices allocated to a container.
+	Allocated(ids []string)
+}
+
+// NewAllocationPolicy returns the policy of the given name, or false if there
+// is no such policy. An empty name is the lowest-index policy.
+func NewAllocationPolicy(name string) (AllocationPolicy, bool) {
+	switch name {
+	case "", AllocationPolicyLowestIndex:
+		return &lowestIndexPolicy{}, true
+	case AllocationPolicyLeastRecentlyUsed:
+		return &leastRecentlyUsedPolicy{lastUsed: map[string]uint64{}}, true
+	case AllocationPolicyRandom:
+		return &randomPolicy{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}, true
+	default:
+		return nil, false
+	}
+}
+
+// deviceIndex returns the index of a device named <name>Mvp<index>, or -1.
+func deviceIndex(id string) int {
+	i := strings.LastIndex(id, suffix)
+	if i < 0 {
+		return -1
+	}
+	index, err := strconv.Atoi(id[i+len(suffix):])
+	if err != nil {
+		return -1
+	}
+	return index
+}
+
+// byIndex sorts device IDs by their numeric index. Devices without one go
+// last, in lexical order.
+func byIndex(ids []string) func(i, j int) bool {
+	return func(i, j int) bool {
+		a, b := deviceIndex(ids[i]), deviceIndex(ids[j])
+		switch {
+		case a >= 0 && b >= 0 && a != b:
+			return a < b
+		case a >= 0 && b < 0:
+			return true
+		case a < 0 && b >= 0:
+			return false
+		default:
+			return ids[i] < ids[j]
+		}
+	}
+}
+
+// preferred returns the devices of mustInclude followed by the other available
+// devices, in the order given by the order function, up to size devices.
+func preferred(available, mustInclude []string, size int, order func(candidates []string)) []string {
+	result := make([]string, 0, size)
+	included := make(map[string]bool, len(mustInclude))
+	for _, id := range mustInclude {
+		if !included[id] {
+			included[id] = true
+			result = append(result, id)
+		}
+	}
+
+	var candidates []string
+	for _, id := range available {
+		if !included[id] {
+			included[id] = true
+			candidates = append(candidates, id)
+		}
+	}
+	order(candidates)
+
+	for _, id := range candidates {
+		if len(result) >= size {
+			break
+		}
+		result = append(result, id)
+	}
+	return result
+}
+
+type lowestIndexPolicy struct{}
+
+func (p *lowestIndexPolicy) Preferred(available, mustInclude []string, size int) []string {
+	return preferred(available, mustInclude, size, func(candidates []string) {
+		sort.SliceStable(candidates, byIndex(candidates))
+	})
+}
+
+func (p *lowestIndexPolicy) Allocated([]string) {}
+
+type leastRecentlyUsedPolicy struct {
+	sync.Mutex
+	// lastUsed tells, for every device allocated so far, the allocation
+	// count at the time of its last allocation.
+	lastUsed    map[string]uint64
+	allocations uint64
+}
+
+func (p *leastRecentlyUsedPolicy) Preferred(available, mustInclude []string, size int) []string {
+	p.Lock()
+	defer p.Unlock()
+	return preferred(available, mustInclude, size, func(candidates []string) {
+		sort.SliceStable(candidates, byIndex(candidates))
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return p.lastUsed[candidates[i]] < p.lastUsed[candidates[j]]
+		})
+	})
+}
+
+func (p *leastRecentlyUsedPolicy) Allocated(ids []string) {
+	p.Lock()
+	defer p.Unlock()
+	p.allocations++
+	for _, id := range ids {
+		p.lastUsed[id] = p.allocations
+	}
+}
+
+type randomPolicy struct {
+	sync.Mutex
+	rand *rand.Rand
+}
+
+func (p *randomPolicy) Preferred(available, mustInclude []string, size int) []string {
+	p.Lock()
+	defer p.Unlock()
+	return preferred(available, mustInclude, size, func(candidates []string) {
+		p.rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	})
+}
+
+func (p *randomPolicy) Allocated([]string) {}
@@ -0,0 +1,118 @@
+package deviceplugin
+
+import (
+	"fmt"
+	"math/rand"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Allocation policy", func() {
+	devices := func(indexes ...int) []string {
+		var ids []string
+		for _, index := range indexes {
+			ids = append(ids, deviceName(index))
+		}
+		return ids
+	}
+
+	Context("WHEN choosing the lowest index", func() {
+		var policy AllocationPolicy
+
+		BeforeEach(func() {
+			policy, _ = NewAllocationPolicy(AllocationPolicyLowestIndex)
+		})
+
+		It("SHOULD sort the devices by numeric index", func() {
+			Expect(policy.Preferred(devices(10, 2, 1, 11), nil, 3)).To(Equal(devices(1, 2, 10)))
+		})
+
+		It("SHOULD include the must-include devices", func() {
+			Expect(policy.Preferred(devices(10, 2, 1, 11), devices(11), 2)).To(Equal(devices(11, 1)))
+		})
+
+		It("SHOULD return only the available devices if there are not enough", func() {
+			Expect(policy.Preferred(devices(3, 1), nil, 4)).To(Equal(devices(1, 3)))
+		})
+
+		It("SHOULD be the default policy", func() {
+			policy, ok := NewAllocationPolicy("")
+			Expect(ok).To(BeTrue())
+			Expect(policy).To(BeAssignableToTypeOf(&lowestIndexPolicy{}))
+		})
+	})
+
+	Context("WHEN choosing the least recently used", func() {
+		var policy AllocationPolicy
+
+		BeforeEach(func() {
+			policy, _ = NewAllocationPolicy(AllocationPolicyLeastRecentlyUsed)
+		})
+
+		It("SHOULD prefer devices never allocated, then the ones allocated longest ago", func() {
+			policy.Allocated(devices(0))
+			policy.Allocated(devices(2))
+			policy.Allocated(devices(1))
+			Expect(policy.Preferred(devices(0, 1, 2, 3), nil, 4)).To(Equal(devices(3, 0, 2, 1)))
+		})
+
+		It("SHOULD include the must-include devices", func() {
+			policy.Allocated(devices(0))
+			Expect(policy.Preferred(devices(0, 1, 2), devices(0), 2)).To(Equal(devices(0, 1)))
+		})
+	})
+
+	Context("WHEN choosing at random", func() {
+		var policy AllocationPolicy
+
+		BeforeEach(func() {
+			policy = &randomPolicy{rand: rand.New(rand.NewSource(1))}
+		})
+
+		It("SHOULD return the requested number of distinct available devices", func() {
+			available := devices(0, 1, 2, 3, 4, 5)
+			preferred := policy.Preferred(available, devices(4), 3)
+			Expect(preferred).To(HaveLen(3))
+			Expect(preferred[0]).To(Equal(deviceName(4)))
+			Expect(available).To(ContainElements(preferred))
+			Expect(preferred[1]).NotTo(Equal(preferred[2]))
+			Expect(preferred[1:]).NotTo(ContainElement(deviceName(4)))
+		})
+	})
+
+	It("SHOULD reject unknown policies", func() {
+		_, ok := NewAllocationPolicy("best-effort")
+		Expect(ok).To(BeFalse())
+	})
+
+	Context("WHEN the plugin is asked for a preferred allocation", func() {
+		It("SHOULD use the policy of the resource", func() {
+			mdp := NewMacvtapDevicePlugin(&macvtapConfig{
+				Config: Config{
+					Name:             "dataplane",
+					AllocationPolicy: AllocationPolicyLowestIndex,
+				},
+			}, "")
+
+			res, err := mdp.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+				ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+					{
+						AvailableDeviceIDs:   []string{"dataplaneMvp10", "dataplaneMvp2", "dataplaneMvp3"},
+						MustIncludeDeviceIDs: []string{"dataplaneMvp3"},
+						AllocationSize:       2,
+					},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.ContainerResponses[0].DeviceIDs).To(Equal([]string{"dataplaneMvp3", "dataplaneMvp2"}))
+		})
+	})
+})
+
+func deviceName(index int) string {
+	return fmt.Sprint("dataplane", suffix, index)
+}
@@ -1,120 +1,244 @@
 package deviceplugin
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/containernetworking/plugins/pkg/ns"
-	"github.com/fsnotify/fsnotify"
 	"github.com/golang/glog"
 	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
 	"github.com/kubevirt/macvtap-cni/pkg/util"
 	"os"
 	"reflect"
-	"time"
 )
 
 func (ml *macvtapLister) ConfigPathDiscover(pluginListCh chan dpm.PluginNameList) {
-	fsWatcher, err := fsnotify.NewWatcher()
+	watcher, err := newConfigFileWatcher(ConfigMapFilePath, configDebounce)
 	if err != nil {
-		glog.Errorf("new file watcher failed: %v", err)
+		glog.Errorf("add config file [%s] watcher failed: %v", ConfigMapFilePath, err)
+		os.Exit(1)
+	}
+	defer watcher.Close()
+
+	// The configuration is read once the directory is watched, so that no
+	// change is missed.
+	data, _, err := watcher.read()
+	if err != nil {
+		glog.Errorf("Error reading config[Path:%s]: %v", ConfigMapFilePath, err)
 		os.Exit(1)
 	}
-	defer fsWatcher.Close()
 
-	var pushPluginList = func() error {
-		var plugins = make(dpm.PluginNameList, 0)
-		newConfig, err := readConfigByPath(ConfigMapFilePath)
+	stop := make(chan struct{})
+	defer close(stop)
+	changes := make(chan []byte)
+	go watcher.run(changes, stop)
+
+	ml.followConfig(pluginListCh, "Path:"+ConfigMapFilePath, data, changes)
+}
+
+// followConfig offers the resources of the given configuration, read from
+// source, and updates them as the configuration changes, if changes is not
+// nil, as the links selectors select change, and as the node labels that
+// node overrides select change.
+func (ml *macvtapLister) followConfig(pluginListCh chan dpm.PluginNameList, source string, data []byte, changes <-chan []byte) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// Resources with selectors are re-evaluated on link events, as links
+	// they select may appear, disappear or change.
+	linkEventCh := make(chan struct{}, 1)
+	go util.OnSuitableMacvtapParentEvent(
+		ml.NetNsPath,
+		func() {
+			select {
+			case linkEventCh <- struct{}{}:
+			default:
+			}
+		},
+		stop,
+		func(err error) {
+			glog.Error(err)
+		})
+	nodeLabelCh := ml.Node.watchLabels(stop)
+
+	// pushConfigs sends the list of resources of the given configurations to
+	// the manager if forced or if it changed.
+	var pushConfigs = func(configs map[string]Config, force bool) error {
+		if len(configs) == 0 {
+			ml.Lock()
+			ml.applyConfigs(configs)
+			ml.Unlock()
+			return ml.discoverByLinks(pluginListCh, false)
+		}
+
+		resolved, err := ml.resolveConfigs(configs)
 		if err != nil {
-			glog.Errorf("Error reading config[Path:%s]: %v", ConfigMapFilePath, err)
+			glog.Errorf("Error resolving config[%s]: %v", source, err)
 			return err
 		}
-		glog.V(3).Infof("Read configuration %+v", newConfig)
 
 		ml.Lock()
-		for _, config := range newConfig {
-			plugins = append(plugins, config.Name)
-			if macvtapCfg, ok := ml.Config[config.Name]; ok {
-				if !reflect.DeepEqual(macvtapCfg.Config, config) {
-					macvtapCfg.Lock()
-					macvtapCfg.Config = config
-					macvtapCfg.Unlock()
-					macvtapCfg.update <- struct{}{}
-				}
-			} else {
-				ml.Config[config.Name] = &macvtapConfig{
-					Config: config,
-					update: make(chan struct{}),
-				}
-			}
-		}
-		// 删除已不存在的配置，防止内存泄漏
-		for name, config := range ml.Config {
-			found := false
-			for _, pluginName := range plugins {
-				if name == pluginName {
-					found = true
-					break
-				}
-			}
-			if !found {
-				close(config.update)
-				delete(ml.Config, name)
-			}
-		}
+		plugins, changed, err := ml.applyConfigs(resolved)
 		ml.Unlock()
-		if len(plugins) > 0 {
-			pluginListCh <- plugins
-			return nil
+		if err != nil {
+			glog.Errorf("Error applying config[%s]: %v", source, err)
+		}
+		if force || changed {
+			ml.publish(pluginListCh, plugins)
 		}
-		return ml.discoverByLinks(pluginListCh, false)
+		return nil
 	}
-loop:
-	if err = fsWatcher.Add(ConfigMapFilePath); err != nil {
-		glog.Errorf("add config file [%s] watcher failed: %v", ConfigMapFilePath, err)
+
+	// An invalid configuration at startup is fatal.
+	current, err := toConfigMap(data, ml.Node)
+	if err != nil {
+		glog.Errorf("Error reading config[%s]: %v", source, err)
 		os.Exit(1)
 	}
-
-	if err = pushPluginList(); err != nil {
+	glog.V(3).Infof("Read configuration %+v", current)
+	if err = pushConfigs(current, true); err != nil {
 		glog.Errorf("pushPluginList error: %v", err)
 		os.Exit(1)
 	}
 
 	for {
 		select {
-		case event, open := <-fsWatcher.Events:
+		case changed, open := <-changes:
 			if !open {
-				glog.Error("watcher event channel closed, exit code 1")
-				os.Exit(1)
+				// Liveness fails so that the plugin is restarted, the
+				// current configuration being offered meanwhile
+				glog.Error("config watcher stopped")
+				ml.configWatcherStopped.Store(true)
+				changes = nil
+				continue
 			}
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				if err = pushPluginList(); err != nil {
-					glog.Errorf("pushPluginList error: %v", err)
-				}
-			} else if event.Op&fsnotify.Write == fsnotify.Write {
-				if err = pushPluginList(); err != nil {
+			// Once started, an invalid configuration is rejected and the
+			// previous one kept.
+			configs, err := toConfigMap(changed, ml.Node)
+			if err != nil {
+				configRejected(fmt.Errorf("error reading config[%s]: %v", source, err))
+				continue
+			}
+			glog.V(3).Infof("Read configuration %+v", configs)
+			configReloads.Inc()
+			data, current = changed, configs
+			if err = pushConfigs(current, false); err != nil {
+				glog.Errorf("pushPluginList error: %v", err)
+			}
+		case <-nodeLabelCh:
+			// The node overrides selected by labels may have changed
+			configs, err := toConfigMap(data, ml.Node)
+			if err != nil {
+				configRejected(fmt.Errorf("error reading config[%s] for the node labels: %v", source, err))
+				continue
+			}
+			if reflect.DeepEqual(configs, current) {
+				continue
+			}
+			glog.Infof("Node labels changed, applying configuration %+v", configs)
+			current = configs
+			if err = pushConfigs(current, false); err != nil {
+				glog.Errorf("pushPluginList error: %v", err)
+			}
+		case <-linkEventCh:
+			if hasSelectors(current) {
+				if err = pushConfigs(current, false); err != nil {
 					glog.Errorf("pushPluginList error: %v", err)
 				}
-			} else if event.Op&fsnotify.Rename == fsnotify.Rename {
-				glog.Errorf("%s rename, restart watcher...", event.Name)
-				time.Sleep(1 * time.Second)
-				goto loop
-			} else if event.Op&fsnotify.Remove == fsnotify.Remove {
-				// TODO 配置文件被删除，重启watcher
-				glog.Errorf("%s removed, restart watcher...", event.Name)
-				time.Sleep(1 * time.Second)
-				goto loop
 			}
-		case err := <-fsWatcher.Errors:
-			glog.Errorf("configmap watching error: %v", err)
+		case _, open := <-pluginListCh:
+			if !open {
+				return
+			}
 		}
 	}
+}
 
+// configRejected reports a configuration that was not applied, the previous
+// one being kept.
+func configRejected(err error) {
+	glog.Errorf("Keeping the previous configuration: %v", err)
+	configReloadErrors.Inc()
+	Events.Warning(ReasonInvalidConfiguration, err.Error())
 }
 
-func (ml *macvtapLister) ConfigEnvDiscover(pluginListCh chan dpm.PluginNameList) {
+// resolveConfigs turns the configurations as read into the configurations of
+// the resources offered on this node: selectors are resolved to the links
+// they select, and VLAN ranges expanded to one resource per VLAN.
+func (ml *macvtapLister) resolveConfigs(configs map[string]Config) (map[string]Config, error) {
+	resolved, err := resolveSelectors(configs, ml.NetNsPath)
+	if err != nil {
+		return nil, err
+	}
+	return expandVlans(resolved), nil
+}
 
+// applyConfigs makes the given configurations the current ones: resources are
+// added, updated or removed, and so are the VLAN sub-interfaces they own. It
+// returns the names of the resources and whether any changed. Resources whose
+// VLAN sub-interfaces can not be created are not offered, and their errors
+// returned. The caller must hold the lister lock.
+func (ml *macvtapLister) applyConfigs(configs map[string]Config) (dpm.PluginNameList, bool, error) {
 	var plugins = make(dpm.PluginNameList, 0)
+	var errs []error
+	var stale []Config
+	changed := false
+	applied := make(map[string]Config, len(configs))
+	for _, config := range configs {
+		if err := ensureVlanLink(config, ml.NetNsPath); err != nil {
+			glog.Errorf("Error creating VLAN sub-interface for %s: %v", config.Name, err)
+			errs = append(errs, fmt.Errorf("resource %s: error creating VLAN sub-interface: %v", config.Name, err))
+			continue
+		}
+		applied[config.Name] = config
+		plugins = append(plugins, config.Name)
+		if macvtapCfg, ok := ml.Config[config.Name]; ok {
+			if !reflect.DeepEqual(macvtapCfg.Config, config) {
+				if !reflect.DeepEqual(macvtapCfg.lowerDevices(), config.lowerDevices()) {
+					stale = append(stale, macvtapCfg.Config)
+				}
+				macvtapCfg.Lock()
+				macvtapCfg.Config = config
+				macvtapCfg.Unlock()
+				macvtapCfg.update <- struct{}{}
+				changed = true
+			}
+		} else {
+			ml.Config[config.Name] = &macvtapConfig{
+				Config: config,
+				update: make(chan struct{}),
+			}
+			changed = true
+		}
+	}
+	// 删除已不存在的配置，防止内存泄漏
+	for name, config := range ml.Config {
+		if _, found := applied[name]; !found {
+			stale = append(stale, config.Config)
+			close(config.update)
+			delete(ml.Config, name)
+			changed = true
+		}
+	}
+	// VLAN sub-interfaces are only deleted once no applied resource uses
+	// them, be it a renamed resource or another one on the same VLAN
+	inUse := linksInUse(applied)
+	for _, config := range stale {
+		if err := deleteVlanLink(config, ml.NetNsPath, inUse); err != nil {
+			glog.Errorf("Error deleting VLAN sub-interface of %s: %v", config.Name, err)
+		}
+	}
+	return plugins, changed, errors.Join(errs...)
+}
+
+func (ml *macvtapLister) ConfigEnvDiscover(pluginListCh chan dpm.PluginNameList) {
+	// Node overrides selected by labels are followed as the labels change
+	data := []byte(os.Getenv(EnvName))
+	if ml.Node.watchable() && hasNodeSelectors(data) {
+		ml.followConfig(pluginListCh, "Env:"+EnvName, data, nil)
+		return
+	}
 
-	config, err := readConfigByEnv(EnvName)
+	config, err := readConfigByEnv(EnvName, ml.Node)
 	if err != nil {
 		glog.Errorf("Error reading config[Env:%s]: %v", EnvName, err)
 		os.Exit(1)
@@ -122,21 +246,28 @@ func (ml *macvtapLister) ConfigEnvDiscover(pluginListCh chan dpm.PluginNameList)
 
 	glog.V(3).Infof("Read configuration %+v", config)
 
-	for _, macvtapConfig := range config {
-		plugins = append(plugins, macvtapConfig.Name)
+	// Resources with selectors are re-evaluated on link events
+	if hasSelectors(config) {
+		if err = ml.discoverBySelectors(pluginListCh, config); err != nil {
+			os.Exit(1)
+		}
+		return
 	}
 
 	// Configuration is static and we don't need to do anything else
 	if len(config) > 0 {
+		resolved, err := ml.resolveConfigs(config)
+		if err != nil {
+			glog.Errorf("Error resolving config[Env:%s]: %v", EnvName, err)
+			os.Exit(1)
+		}
 		ml.Lock()
 		defer ml.Unlock()
-		for _, cfg := range config {
-			ml.Config[cfg.Name] = &macvtapConfig{
-				Config: cfg,
-				update: make(chan struct{}),
-			}
+		plugins, _, err := ml.applyConfigs(resolved)
+		if err != nil {
+			glog.Errorf("Error applying config[Env:%s]: %v", EnvName, err)
 		}
-		pluginListCh <- plugins
+		ml.publish(pluginListCh, plugins)
 		return
 	}
 
@@ -147,31 +278,66 @@ func (ml *macvtapLister) ConfigEnvDiscover(pluginListCh chan dpm.PluginNameList)
 	}
 }
 
-func readConfigByPath(configPath string) (map[string]Config, error) {
-	var configs []Config
-	configMap := make(map[string]Config)
-	jsonBytes, err := os.ReadFile(configPath)
-	if err != nil {
-		return configMap, err
-	}
+// discoverBySelectors offers the resources of the given configurations, and
+// updates them on link events as the links their selectors select change.
+func (ml *macvtapLister) discoverBySelectors(pluginListCh chan dpm.PluginNameList, configs map[string]Config) error {
+	// As in discoverByLinks, a middle channel avoids reading our own updates
+	// when watching for the manager to stop.
+	linkEventCh := make(chan struct{}, 1)
+	linkEventCh <- struct{}{}
 
-	if err := json.Unmarshal(jsonBytes, &configs); err != nil {
-		return configMap, err
-	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go util.OnSuitableMacvtapParentEvent(
+		ml.NetNsPath,
+		func() {
+			select {
+			case linkEventCh <- struct{}{}:
+			default:
+			}
+		},
+		stop,
+		func(err error) {
+			glog.Error(err)
+		})
 
-	for _, cfg := range configs {
-		configMap[cfg.Name] = cfg
+	first := true
+	for {
+		select {
+		case <-linkEventCh:
+			resolved, err := ml.resolveConfigs(configs)
+			if err != nil {
+				glog.Errorf("Error resolving selectors: %v", err)
+				if first {
+					return err
+				}
+				continue
+			}
+			ml.Lock()
+			plugins, changed, err := ml.applyConfigs(resolved)
+			ml.Unlock()
+			if err != nil {
+				glog.Errorf("Error applying config: %v", err)
+			}
+			if first || changed {
+				ml.publish(pluginListCh, plugins)
+			}
+			first = false
+		case _, open := <-pluginListCh:
+			if !open {
+				return nil
+			}
+		}
 	}
+}
 
-	return configMap, nil
+func readConfigByEnv(envName string, node *NodeSource) (map[string]Config, error) {
+	return toConfigMap([]byte(os.Getenv(envName)), node)
 }
 
-func readConfigByEnv(envName string) (map[string]Config, error) {
-	var configs []Config
+func toConfigMap(data []byte, node *NodeSource) (map[string]Config, error) {
 	configMap := make(map[string]Config)
-
-	configEnv := os.Getenv(envName)
-	err := json.Unmarshal([]byte(configEnv), &configs)
+	configs, err := ParseNodeConfig(data, node)
 	if err != nil {
 		return configMap, err
 	}
@@ -247,7 +413,7 @@ func (ml *macvtapLister) discoverByLinks(pluginListCh chan dpm.PluginNameList, k
 				}
 			}
 			ml.Unlock()
-			pluginListCh <- parentNames
+			ml.publish(pluginListCh, parentNames)
 			if !keepRun {
 				return nil
 			}
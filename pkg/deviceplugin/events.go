@@ -0,0 +1,60 @@
+package deviceplugin
+
+import (
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventComponent = "macvtap-deviceplugin"
+
+	// ReasonInvalidConfiguration is the reason of the Events emitted when a
+	// configuration is rejected.
+	ReasonInvalidConfiguration = "InvalidConfiguration"
+)
+
+// NodeEventRecorder emits Events about the node the device plugin runs on.
+type NodeEventRecorder interface {
+	Warning(reason, message string)
+}
+
+// Events records the Events of the device plugin. Unless set, Events are
+// only logged.
+var Events NodeEventRecorder = logEventRecorder{}
+
+type logEventRecorder struct{}
+
+func (logEventRecorder) Warning(reason, message string) {
+	glog.V(3).Infof("Event %s not recorded: %s", reason, message)
+}
+
+type nodeEventRecorder struct {
+	recorder record.EventRecorder
+	node     *corev1.ObjectReference
+}
+
+// NewNodeEventRecorder returns a recorder of Events about the given node
+// through the API server.
+func NewNodeEventRecorder(client kubernetes.Interface, nodeName string) NodeEventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &nodeEventRecorder{
+		recorder: broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent, Host: nodeName}),
+		// As the kubelet does, the node name stands for its UID, so that
+		// Events show up when describing the node
+		node: &corev1.ObjectReference{
+			Kind: "Node",
+			Name: nodeName,
+			UID:  types.UID(nodeName),
+		},
+	}
+}
+
+func (r *nodeEventRecorder) Warning(reason, message string) {
+	r.recorder.Event(r.node, corev1.EventTypeWarning, reason, message)
+}
@@ -0,0 +1,144 @@
+package deviceplugin
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/golang/glog"
+
+	"github.com/kubevirt/macvtap-cni/pkg/devinfo"
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+const (
+	// DefaultGCInterval is how often leaked links are looked for by default.
+	DefaultGCInterval = time.Minute
+	// DefaultGCGracePeriod is how long a link has to be owned by no pod
+	// before it is deleted by default.
+	DefaultGCGracePeriod = 5 * time.Minute
+)
+
+// LeakedLinkCollector deletes the links created by Allocate that were never
+// moved into a pod, for instance because the pod sandbox creation failed.
+// Links named <resource>Mvp<N> that remain in the plugin namespace while no pod
+// owns the device, according to the kubelet PodResources API, for longer than
+// a grace period are deleted.
+type LeakedLinkCollector struct {
+	// Socket is the kubelet PodResources API socket.
+	Socket      string
+	Interval    time.Duration
+	GracePeriod time.Duration
+
+	listLinks  func() ([]util.DeviceLink, error)
+	deleteLink func(link util.DeviceLink) (bool, error)
+	now        func() time.Time
+
+	// unowned tells when each link was first seen owned by no pod.
+	unowned map[util.DeviceLink]time.Time
+	deleted uint64
+}
+
+func NewLeakedLinkCollector(netNsPath, socket string, interval, gracePeriod time.Duration) *LeakedLinkCollector {
+	return &LeakedLinkCollector{
+		Socket:      socket,
+		Interval:    interval,
+		GracePeriod: gracePeriod,
+		listLinks: func() ([]util.DeviceLink, error) {
+			var links []util.DeviceLink
+			err := ns.WithNetNSPath(netNsPath, func(_ ns.NetNS) error {
+				var err error
+				links, err = util.ListDeviceLinks()
+				return err
+			})
+			return links, err
+		},
+		deleteLink: func(link util.DeviceLink) (bool, error) {
+			var deleted bool
+			err := ns.WithNetNSPath(netNsPath, func(_ ns.NetNS) error {
+				var err error
+				// The index check spares a link recreated in the meantime
+				// by Allocate for another pod
+				deleted, err = util.DeleteMacvtapWithIndex(link.Name, link.Index)
+				return err
+			})
+			return deleted, err
+		},
+		now:     time.Now,
+		unowned: make(map[util.DeviceLink]time.Time),
+	}
+}
+
+// Run collects leaked links every Interval until stop is closed.
+func (c *LeakedLinkCollector) Run(stop <-chan struct{}) {
+	glog.Infof("Collecting leaked links every %v with a grace period of %v", c.Interval, c.GracePeriod)
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.collect(); err != nil {
+				glog.Warningf("Failed to collect leaked links: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Deleted returns the number of leaked links deleted so far.
+func (c *LeakedLinkCollector) Deleted() uint64 {
+	return atomic.LoadUint64(&c.deleted)
+}
+
+func (c *LeakedLinkCollector) collect() error {
+	links, err := c.listLinks()
+	if err != nil {
+		return err
+	}
+	if len(links) == 0 {
+		c.unowned = make(map[util.DeviceLink]time.Time)
+		return nil
+	}
+
+	// Without knowing the owned devices, no link is safe to delete
+	devices, err := listContainerDevices(c.Socket)
+	if err != nil {
+		return err
+	}
+	owners.update(devices)
+
+	now := c.now()
+	unowned := make(map[util.DeviceLink]time.Time)
+	for _, link := range links {
+		if _, owned := owners.owner(util.ResourceNameFromDevice(link.Name), link.Name); owned {
+			continue
+		}
+		since, seen := c.unowned[link]
+		if !seen {
+			since = now
+		}
+		if now.Sub(since) < c.GracePeriod {
+			glog.V(3).Infof("Link %s is owned by no pod since %v", link.Name, since)
+			unowned[link] = since
+			continue
+		}
+
+		deleted, err := c.deleteLink(link)
+		if err != nil {
+			glog.Errorf("Failed to delete leaked link %s: %v", link.Name, err)
+			unowned[link] = since
+			continue
+		}
+		if deleted {
+			gcDeletedLinks.WithLabelValues(util.ResourceNameFromDevice(link.Name)).Inc()
+			total := atomic.AddUint64(&c.deleted, 1)
+			glog.Infof("Deleted leaked link %s, owned by no pod since %v (%d deleted so far)", link.Name, since, total)
+			if err := devinfo.CleanForDP(util.ResourceNameFromDevice(link.Name), link.Name); err != nil {
+				glog.Warningf("Failed to remove the device info of leaked link %s: %v", link.Name, err)
+			}
+		}
+	}
+	c.unowned = unowned
+	return nil
+}
@@ -0,0 +1,109 @@
+package deviceplugin
+
+import (
+	"time"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Leaked link collector", func() {
+	const gracePeriod = 5 * time.Minute
+
+	var (
+		server    *fakePodResourcesServer
+		collector *LeakedLinkCollector
+		links     []util.DeviceLink
+		deleted   []util.DeviceLink
+		now       time.Time
+	)
+
+	BeforeEach(func() {
+		server = startFakePodResourcesServer()
+		links = []util.DeviceLink{
+			{Name: "dataplaneMvp0", Index: 10},
+			{Name: "dataplaneMvp1", Index: 11},
+		}
+		deleted = nil
+		now = time.Now()
+
+		collector = NewLeakedLinkCollector("", server.socket, time.Minute, gracePeriod)
+		collector.listLinks = func() ([]util.DeviceLink, error) {
+			return links, nil
+		}
+		collector.deleteLink = func(link util.DeviceLink) (bool, error) {
+			deleted = append(deleted, link)
+			return true, nil
+		}
+		collector.now = func() time.Time {
+			return now
+		}
+	})
+
+	AfterEach(func() {
+		server.stop()
+	})
+
+	It("SHOULD delete links owned by no pod once the grace period is over", func() {
+		server.setDevices(resourceNamespace+"/dataplane", map[string][]string{
+			"compute": {"dataplaneMvp0"},
+		})
+
+		By("sparing the links within the grace period", func() {
+			Expect(collector.collect()).To(Succeed())
+			now = now.Add(gracePeriod - time.Second)
+			Expect(collector.collect()).To(Succeed())
+			Expect(deleted).To(BeEmpty())
+		})
+
+		By("deleting the unowned link after the grace period", func() {
+			deletedLinks := testutil.ToFloat64(gcDeletedLinks.WithLabelValues(resourceNamespace + "/dataplane"))
+			now = now.Add(time.Second)
+			Expect(collector.collect()).To(Succeed())
+			Expect(deleted).To(ConsistOf(util.DeviceLink{Name: "dataplaneMvp1", Index: 11}))
+			Expect(collector.Deleted()).To(BeEquivalentTo(1))
+			Expect(testutil.ToFloat64(gcDeletedLinks.WithLabelValues(resourceNamespace + "/dataplane"))).To(Equal(deletedLinks + 1))
+		})
+	})
+
+	It("SHOULD restart the grace period of a link recreated under the same name", func() {
+		Expect(collector.collect()).To(Succeed())
+		links = []util.DeviceLink{{Name: "dataplaneMvp0", Index: 20}}
+		now = now.Add(gracePeriod)
+		Expect(collector.collect()).To(Succeed())
+		Expect(deleted).To(BeEmpty())
+	})
+
+	It("SHOULD restart the grace period of a link owned in the meantime", func() {
+		Expect(collector.collect()).To(Succeed())
+		server.setDevices(resourceNamespace+"/dataplane", map[string][]string{
+			"compute": {"dataplaneMvp0", "dataplaneMvp1"},
+		})
+		now = now.Add(gracePeriod)
+		Expect(collector.collect()).To(Succeed())
+		server.setDevices(resourceNamespace+"/dataplane", nil)
+		Expect(collector.collect()).To(Succeed())
+		Expect(deleted).To(BeEmpty())
+	})
+
+	It("SHOULD not consider devices of another resource as owned", func() {
+		server.setDevices(resourceNamespace+"/other", map[string][]string{
+			"compute": {"dataplaneMvp0", "dataplaneMvp1"},
+		})
+		Expect(collector.collect()).To(Succeed())
+		now = now.Add(gracePeriod)
+		Expect(collector.collect()).To(Succeed())
+		Expect(deleted).To(HaveLen(2))
+	})
+
+	It("SHOULD delete nothing when the PodResources API is not available", func() {
+		server.stop()
+		Expect(collector.collect()).NotTo(Succeed())
+		now = now.Add(gracePeriod)
+		Expect(collector.collect()).NotTo(Succeed())
+		Expect(deleted).To(BeEmpty())
+	})
+})
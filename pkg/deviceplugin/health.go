@@ -0,0 +1,57 @@
+package deviceplugin
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+// DefaultLinkSubscriptionTimeout is how long a link event subscription may be
+// down before the device plugin is considered not alive, by default.
+const DefaultLinkSubscriptionTimeout = time.Minute
+
+// publish sends the list of resources to the manager.
+func (ml *macvtapLister) publish(pluginListCh chan dpm.PluginNameList, plugins dpm.PluginNameList) {
+	pluginListCh <- plugins
+	ml.published.Store(true)
+}
+
+// Ready returns an error unless the lister published its resources, and
+// every one of them registered with the kubelet and reported its devices.
+func (ml *macvtapLister) Ready() error {
+	if !ml.published.Load() {
+		return errors.New("resources not published yet")
+	}
+
+	ml.RLock()
+	defer ml.RUnlock()
+	var pending []string
+	for name, cfg := range ml.Config {
+		if !cfg.listed.Load() {
+			pending = append(pending, name)
+		}
+	}
+	if len(pending) > 0 {
+		sort.Strings(pending)
+		return fmt.Errorf("devices of %v not reported to the kubelet yet", pending)
+	}
+	return nil
+}
+
+// Alive returns an error if the device plugin no longer follows the changes
+// it should: when a link event subscription has been down for longer than
+// the given timeout, or when the configuration watcher stopped.
+func (ml *macvtapLister) Alive(linkSubscriptionTimeout time.Duration) error {
+	if ml.configWatcherStopped.Load() {
+		return errors.New("configuration watcher stopped")
+	}
+	if since, down := util.LinkSubscriptionsDownSince(); down && time.Since(since) > linkSubscriptionTimeout {
+		return fmt.Errorf("link event subscription down since %v", since.Format(time.RFC3339))
+	}
+	return nil
+}
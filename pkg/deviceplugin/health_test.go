@@ -0,0 +1,56 @@
+package deviceplugin
+
+import (
+	"time"
+
+	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	var lister *macvtapLister
+
+	BeforeEach(func() {
+		lister = NewMacvtapLister("", ListerTypeConfigEnv)
+		lister.Config["dataplane"] = &macvtapConfig{Config: Config{Name: "dataplane", LowerDevice: "eth0"}}
+		lister.Config["storage"] = &macvtapConfig{Config: Config{Name: "storage", LowerDevice: "eth1"}}
+	})
+
+	Context("WHEN checking readiness", func() {
+		It("SHOULD not be ready until the resources are published", func() {
+			Expect(lister.Ready()).To(MatchError("resources not published yet"))
+		})
+
+		It("SHOULD not be ready until every resource reported its devices", func() {
+			pluginListCh := make(chan dpm.PluginNameList, 1)
+			lister.publish(pluginListCh, dpm.PluginNameList{"dataplane", "storage"})
+			Expect(lister.Ready()).To(MatchError("devices of [dataplane storage] not reported to the kubelet yet"))
+
+			lister.Config["dataplane"].listed.Store(true)
+			Expect(lister.Ready()).To(MatchError("devices of [storage] not reported to the kubelet yet"))
+
+			lister.Config["storage"].listed.Store(true)
+			Expect(lister.Ready()).To(Succeed())
+		})
+
+		It("SHOULD be ready without resources once published", func() {
+			lister.Config = make(map[string]*macvtapConfig)
+			pluginListCh := make(chan dpm.PluginNameList, 1)
+			lister.publish(pluginListCh, dpm.PluginNameList{})
+			Expect(lister.Ready()).To(Succeed())
+		})
+	})
+
+	Context("WHEN checking liveness", func() {
+		It("SHOULD be alive while following changes", func() {
+			Expect(lister.Alive(time.Hour)).To(Succeed())
+		})
+
+		It("SHOULD not be alive once the configuration watcher stopped", func() {
+			lister.configWatcherStopped.Store(true)
+			Expect(lister.Alive(time.Hour)).To(MatchError("configuration watcher stopped"))
+		})
+	})
+})
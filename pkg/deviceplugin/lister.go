@@ -2,24 +2,29 @@ package deviceplugin
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/golang/glog"
 	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
 )
 
 var (
 	ConfigMapFilePath string
 	EnvName           string
-	SortDeviceIds     bool
 )
 
 const (
-	resourceNamespace         = "macvtap.network.kubevirt.io"
+	resourceNamespace         = util.ResourceNamespace
 	ConfigEnvironmentVariable = "DP_MACVTAP_CONF"
 	ConfigMapDefaultPath      = "/macvtap-deviceplugin-config/" + ConfigEnvironmentVariable
 
 	ListerTypeConfigEnv  = "configEnv"
 	ListerTypeConfigPath = "configPath"
+	// ListerTypeResourcePool reads the configuration from the
+	// MacvtapResourcePools selecting the node.
+	ListerTypeResourcePool = "resourcePool"
 )
 
 type Config struct {
@@ -27,12 +32,44 @@ type Config struct {
 	LowerDevice string `json:"lowerDevice"`
 	Mode        string `json:"mode"`
 	Capacity    int    `json:"capacity"`
+	// Type is the type of the devices, macvtap by default or ipvtap. The
+	// Mode of ipvtap devices is one of l2, l3 or l3s.
+	Type string `json:"type,omitempty"`
+	// Queues is the number of queues of the macvtap devices. With more than
+	// one, the devices are multiqueue and their tap device can be opened once
+	// per queue.
+	Queues int `json:"queues,omitempty"`
+	// VLAN makes the plugin create and own a VLAN sub-interface of
+	// LowerDevice for each ID in the range, and offer one resource per VLAN
+	// with the sub-interface as macvtap parent.
+	VLAN *VlanRange `json:"vlan,omitempty"`
+	// Selectors select the lower devices of the resource among the links of
+	// the node, instead of LowerDevice or LowerDevices.
+	Selectors *Selectors `json:"selectors,omitempty"`
+	// LowerDevices backs the resource with several lower devices instead of
+	// LowerDevice. Each device is created on one of them, picked by
+	// LowerDeviceStrategy: round-robin (default), least-used or
+	// first-healthy.
+	LowerDevices        []string `json:"lowerDevices,omitempty"`
+	LowerDeviceStrategy string   `json:"lowerDeviceStrategy,omitempty"`
+	// AllocationPolicy selects the devices preferred for allocation:
+	// lowest-index (default), least-recently-used or random.
+	AllocationPolicy string `json:"allocationPolicy,omitempty"`
+
+	// vlanParents and vlanID are set on the per-VLAN configurations, whose
+	// lower devices are VLAN sub-interfaces owned by the plugin, of the
+	// respective vlanParents.
+	vlanParents []string
+	vlanID      int
 }
 
 type macvtapConfig struct {
 	sync.RWMutex
 	Config
 	update chan struct{}
+	// listed tells whether the devices of the resource were reported to
+	// the kubelet since the plugin last started.
+	listed atomic.Bool
 }
 
 type macvtapLister struct {
@@ -41,6 +78,18 @@ type macvtapLister struct {
 	// NetNsPath is the path to the network namespace the lister operates in.
 	NetNsPath string
 	Type      string
+	// Node selects the node overrides of the configuration that apply, if
+	// set.
+	Node *NodeSource
+	// PoolSource is where the resourcePool lister reads the configuration
+	// from.
+	PoolSource *ResourcePoolSource
+
+	// published tells whether the resources were sent to the manager, and
+	// configWatcherStopped whether the configuration file is no longer
+	// followed.
+	published            atomic.Bool
+	configWatcherStopped atomic.Bool
 }
 
 func NewMacvtapLister(netNsPath, listerType string) *macvtapLister {
@@ -51,7 +100,7 @@ func NewMacvtapLister(netNsPath, listerType string) *macvtapLister {
 	}
 }
 
-func (ml macvtapLister) GetResourceNamespace() string {
+func (ml *macvtapLister) GetResourceNamespace() string {
 	return resourceNamespace
 }
 
@@ -61,6 +110,8 @@ func (ml *macvtapLister) Discover(pluginListCh chan dpm.PluginNameList) {
 		ml.ConfigEnvDiscover(pluginListCh)
 	case ListerTypeConfigPath:
 		ml.ConfigPathDiscover(pluginListCh)
+	case ListerTypeResourcePool:
+		ml.ResourcePoolDiscover(pluginListCh)
 	}
 }
 
@@ -80,5 +131,5 @@ func (ml *macvtapLister) NewPlugin(name string) dpm.PluginInterface {
 		}
 	}
 	glog.V(3).Infof("Creating device plugin with config %+v", cfg)
-	return NewMacvtapDevicePlugin(cfg, ml.NetNsPath, SortDeviceIds)
+	return NewMacvtapDevicePlugin(cfg, ml.NetNsPath)
 }
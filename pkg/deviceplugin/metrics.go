@@ -0,0 +1,96 @@
+package deviceplugin
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const metricsNamespace = "macvtap_deviceplugin"
+
+// Registry holds the metrics of the device plugin.
+var Registry = prometheus.NewRegistry()
+
+var (
+	advertisedDevices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "devices",
+		Help:      "Number of devices advertised to the kubelet.",
+	}, []string{"resource"})
+	healthyDevices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "healthy_devices",
+		Help:      "Number of devices advertised to the kubelet as healthy.",
+	}, []string{"resource"})
+	allocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "allocations_total",
+		Help:      "Number of Allocate calls from the kubelet.",
+	}, []string{"resource"})
+	allocationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "allocation_failures_total",
+		Help:      "Number of Allocate calls from the kubelet that failed.",
+	}, []string{"resource"})
+	allocationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "allocation_duration_seconds",
+		Help:      "Duration of the Allocate calls from the kubelet.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"resource"})
+	recreateFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "recreate_failures_total",
+		Help:      "Number of devices that failed to be created on allocation.",
+	}, []string{"resource"})
+	lowerDeviceTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "lower_device_transitions_total",
+		Help:      "Number of times a lower device went up or down.",
+	}, []string{"resource", "lower_device", "state"})
+	configReloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of configuration reloads applied.",
+	})
+	configReloadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reload_errors_total",
+		Help:      "Number of configuration reloads rejected as invalid, the previous configuration being kept.",
+	})
+	gcDeletedLinks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gc_deleted_links_total",
+		Help:      "Number of leaked links deleted.",
+	}, []string{"resource"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		advertisedDevices,
+		healthyDevices,
+		allocations,
+		allocationFailures,
+		allocationDuration,
+		recreateFailures,
+		lowerDeviceTransitions,
+		configReloads,
+		configReloadErrors,
+		gcDeletedLinks,
+	)
+}
+
+// lowerDeviceState is the state label of a lower device transition.
+func lowerDeviceState(healthy bool) string {
+	if healthy {
+		return "up"
+	}
+	return "down"
+}
+
+// forgetResource removes the gauges of a resource no longer offered.
+func forgetResource(resourceName string) {
+	advertisedDevices.DeleteLabelValues(resourceName)
+	healthyDevices.DeleteLabelValues(resourceName)
+}
@@ -0,0 +1,57 @@
+package deviceplugin
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	It("SHOULD count the failed allocations", func() {
+		const resourceName = resourceNamespace + "/metrics"
+		mdp := NewMacvtapDevicePlugin(&macvtapConfig{
+			Config: Config{Name: "metrics", LowerDevice: "missing0"},
+		}, "/nonexistent/netns")
+
+		_, err := mdp.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: []string{"metricsMvp0"}},
+			},
+		})
+		Expect(err).To(HaveOccurred())
+
+		Expect(testutil.ToFloat64(allocations.WithLabelValues(resourceName))).To(BeEquivalentTo(1))
+		Expect(testutil.ToFloat64(allocationFailures.WithLabelValues(resourceName))).To(BeEquivalentTo(1))
+		Expect(testutil.ToFloat64(recreateFailures.WithLabelValues(resourceName))).To(BeEquivalentTo(1))
+		Expect(testutil.CollectAndCount(allocationDuration, metricsNamespace+"_allocation_duration_seconds")).To(BeNumerically(">=", 1))
+	})
+
+	It("SHOULD forget the gauges of a resource no longer offered", func() {
+		const resourceName = resourceNamespace + "/forgotten"
+		advertisedDevices.WithLabelValues(resourceName).Set(10)
+		healthyDevices.WithLabelValues(resourceName).Set(10)
+
+		forgetResource(resourceName)
+
+		Expect(advertisedDevices.DeleteLabelValues(resourceName)).To(BeFalse())
+		Expect(healthyDevices.DeleteLabelValues(resourceName)).To(BeFalse())
+	})
+
+	It("SHOULD be gathered from the registry", func() {
+		configReloads.Add(0)
+		families, err := Registry.Gather()
+		Expect(err).NotTo(HaveOccurred())
+		var names []string
+		for _, family := range families {
+			names = append(names, family.GetName())
+		}
+		Expect(names).To(ContainElements(
+			metricsNamespace+"_config_reloads_total",
+			metricsNamespace+"_config_reload_errors_total",
+			"go_goroutines",
+		))
+	})
+})
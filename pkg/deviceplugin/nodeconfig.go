@@ -0,0 +1,247 @@
+package deviceplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// configFile is the configuration shared by all nodes. It is either a JSON
+// list of resources, or an object holding the resources of every node and
+// the overrides of some nodes:
+//
+//	{
+//	  "resources": [ {"name": "dataplane", "lowerDevice": "eth0"} ],
+//	  "nodes": [
+//	    {"nodeName": "node01", "resources": [ {"name": "dataplane", "lowerDevice": "ens1f0"} ]},
+//	    {"nodeSelector": {"matchLabels": {"nic": "ice"}}, "resources": [ ... ]}
+//	  ]
+//	}
+type configFile struct {
+	Resources []json.RawMessage `json:"resources"`
+	Nodes     []nodeOverride    `json:"nodes,omitempty"`
+}
+
+// nodeOverride changes the resources of the nodes it selects, by name or by
+// labels. Each of its resources is merged over the resource of the same name,
+// as a JSON merge patch, or added if there is none.
+type nodeOverride struct {
+	NodeName     string                `json:"nodeName,omitempty"`
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+	Resources    []json.RawMessage     `json:"resources"`
+}
+
+// NodeSource is the node the device plugin runs on, whose name and labels
+// select the overrides of the configuration that apply.
+type NodeSource struct {
+	Name string
+	// Labels are the labels of the node, read from Client if set.
+	Labels map[string]string
+	Client kubernetes.Interface
+}
+
+func (n *NodeSource) labels() (labels.Set, error) {
+	if n.Client == nil {
+		return n.Labels, nil
+	}
+	node, err := n.Client.CoreV1().Nodes().Get(context.Background(), n.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting node %s: %v", n.Name, err)
+	}
+	return node.Labels, nil
+}
+
+// watchable tells whether the labels of the node can be watched.
+func (n *NodeSource) watchable() bool {
+	return n != nil && n.Client != nil
+}
+
+// watchLabels notifies of the changes of the labels of the node until stop is
+// closed. It returns nil if they can not be watched.
+func (n *NodeSource) watchLabels(stop <-chan struct{}) <-chan struct{} {
+	if !n.watchable() {
+		return nil
+	}
+	changes := make(chan struct{}, 1)
+	factory := nodeInformerFactory(n.Client, n.Name, 0)
+	factory.Core().V1().Nodes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, oldOk := oldObj.(*corev1.Node)
+			newNode, newOk := newObj.(*corev1.Node)
+			if !oldOk || !newOk || reflect.DeepEqual(oldNode.Labels, newNode.Labels) {
+				return
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		},
+	})
+	factory.Start(stop)
+	return changes
+}
+
+// nodeInformerFactory returns an informer factory limited to the given node.
+func nodeInformerFactory(client kubernetes.Interface, nodeName string, resync time.Duration) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(client, resync,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", nodeName).String()
+		}))
+}
+
+// hasNodeSelectors tells whether the configuration has node overrides that
+// select nodes by labels. Invalid configurations have none.
+func hasNodeSelectors(data []byte) bool {
+	file, err := parseConfigFile(data)
+	if err != nil {
+		return false
+	}
+	for _, override := range file.Nodes {
+		if override.NodeSelector != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func parseConfigFile(data []byte) (*configFile, error) {
+	file := &configFile{}
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &file.Resources); err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// validateOverrides checks the node overrides: that each selects nodes one
+// way, and that the resources of the nodes it selects are valid.
+func (f *configFile) validateOverrides() error {
+	var errs []error
+	for i, override := range f.Nodes {
+		entry := fmt.Sprintf("nodes entry %d", i)
+		switch {
+		case override.NodeName == "" && override.NodeSelector == nil:
+			errs = append(errs, fmt.Errorf("%s: one of nodeName or nodeSelector is required", entry))
+			continue
+		case override.NodeName != "" && override.NodeSelector != nil:
+			errs = append(errs, fmt.Errorf("%s: only one of nodeName or nodeSelector can be set", entry))
+			continue
+		case override.NodeSelector != nil:
+			if _, err := metav1.LabelSelectorAsSelector(override.NodeSelector); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid nodeSelector: %v", entry, err))
+				continue
+			}
+		}
+		configs, err := mergeResources(f.Resources, override)
+		if err == nil {
+			err = ValidateConfigs(configs)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", entry, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// forNode returns the resources of the node: the shared ones with the
+// overrides selecting the node merged over, in order.
+func (f *configFile) forNode(node *NodeSource) ([]Config, error) {
+	var nodeLabels labels.Set
+	var overrides []nodeOverride
+	for _, override := range f.Nodes {
+		if node == nil {
+			break
+		}
+		if override.NodeName != "" {
+			if override.NodeName == node.Name {
+				overrides = append(overrides, override)
+			}
+			continue
+		}
+		if nodeLabels == nil {
+			var err error
+			if nodeLabels, err = node.labels(); err != nil {
+				return nil, err
+			}
+			if nodeLabels == nil {
+				nodeLabels = labels.Set{}
+			}
+		}
+		selector, err := metav1.LabelSelectorAsSelector(override.NodeSelector)
+		if err != nil {
+			return nil, err
+		}
+		if selector.Matches(nodeLabels) {
+			overrides = append(overrides, override)
+		}
+	}
+	return mergeResources(f.Resources, overrides...)
+}
+
+// mergeResources merges the resources of the overrides over the given ones.
+func mergeResources(resources []json.RawMessage, overrides ...nodeOverride) ([]Config, error) {
+	merged := make([]json.RawMessage, len(resources))
+	copy(merged, resources)
+	for _, override := range overrides {
+		for _, resource := range override.Resources {
+			var named struct {
+				Name string `json:"name"`
+			}
+			if err := json.Unmarshal(resource, &named); err != nil {
+				return nil, err
+			}
+			found := false
+			for i := range merged {
+				var existing struct {
+					Name string `json:"name"`
+				}
+				if err := json.Unmarshal(merged[i], &existing); err != nil {
+					return nil, err
+				}
+				if named.Name != "" && existing.Name == named.Name {
+					patched, err := jsonpatch.MergePatch(merged[i], resource)
+					if err != nil {
+						return nil, fmt.Errorf("error merging resource %s: %v", named.Name, err)
+					}
+					merged[i] = patched
+					found = true
+					break
+				}
+			}
+			if !found {
+				merged = append(merged, resource)
+			}
+		}
+	}
+
+	configs := make([]Config, 0, len(merged))
+	for _, resource := range merged {
+		var cfg Config
+		if err := json.Unmarshal(resource, &cfg); err != nil {
+			return nil, err
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
@@ -0,0 +1,180 @@
+package deviceplugin
+
+import (
+	"context"
+
+	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Node overrides", func() {
+	const config = `{
+		"resources": [
+			{"name": "dataplane", "lowerDevice": "eth0", "capacity": 20},
+			{"name": "storage", "lowerDevice": "eth1"}
+		],
+		"nodes": [
+			{"nodeSelector": {"matchLabels": {"nic": "ice"}}, "resources": [
+				{"name": "dataplane", "lowerDevice": null, "selectors": {"drivers": ["ice"]}},
+				{"name": "fast", "lowerDevice": "ens2f0"}
+			]},
+			{"nodeName": "node01", "resources": [
+				{"name": "dataplane", "capacity": 50}
+			]}
+		]
+	}`
+
+	node := func(name string, labels map[string]string) *NodeSource {
+		client := fake.NewSimpleClientset(&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		})
+		return &NodeSource{Name: name, Client: client}
+	}
+
+	It("SHOULD still accept a list of resources", func() {
+		configs, err := ParseNodeConfig([]byte(`[{"name":"dataplane","lowerDevice":"eth0"}]`), node("node01", nil))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configs).To(Equal([]Config{{Name: "dataplane", LowerDevice: "eth0"}}))
+	})
+
+	It("SHOULD give the shared resources to the nodes no override selects", func() {
+		configs, err := ParseNodeConfig([]byte(config), node("node02", map[string]string{"nic": "i40e"}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configs).To(Equal([]Config{
+			{Name: "dataplane", LowerDevice: "eth0", Capacity: 20},
+			{Name: "storage", LowerDevice: "eth1"},
+		}))
+	})
+
+	It("SHOULD merge the overrides selecting the node by labels", func() {
+		configs, err := ParseNodeConfig([]byte(config), node("node02", map[string]string{"nic": "ice"}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configs).To(Equal([]Config{
+			{Name: "dataplane", Capacity: 20, Selectors: &Selectors{Drivers: []string{"ice"}}},
+			{Name: "storage", LowerDevice: "eth1"},
+			{Name: "fast", LowerDevice: "ens2f0"},
+		}))
+	})
+
+	It("SHOULD merge the overrides selecting the node by name, in order", func() {
+		configs, err := ParseNodeConfig([]byte(config), node("node01", map[string]string{"nic": "ice"}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configs).To(Equal([]Config{
+			{Name: "dataplane", Capacity: 50, Selectors: &Selectors{Drivers: []string{"ice"}}},
+			{Name: "storage", LowerDevice: "eth1"},
+			{Name: "fast", LowerDevice: "ens2f0"},
+		}))
+	})
+
+	It("SHOULD use the given labels without client", func() {
+		configs, err := ParseNodeConfig([]byte(config), &NodeSource{Name: "node02", Labels: map[string]string{"nic": "ice"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configs).To(HaveLen(3))
+	})
+
+	It("SHOULD fail when the node can not be read", func() {
+		client := fake.NewSimpleClientset()
+		_, err := ParseNodeConfig([]byte(config), &NodeSource{Name: "node02", Client: client})
+		Expect(err).To(MatchError(ContainSubstring("error getting node node02")))
+	})
+
+	It("SHOULD return the shared resources without node", func() {
+		configs, err := ParseConfig([]byte(config))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configs).To(HaveLen(2))
+	})
+
+	Context("WHEN an override is invalid", func() {
+		invalid := []struct{ description, config, message string }{
+			{"without node", `{"resources":[],"nodes":[{"resources":[]}]}`, "nodes entry 0: one of nodeName or nodeSelector is required"},
+			{"with both node name and selector", `{"resources":[],"nodes":[{"nodeName":"node01","nodeSelector":{},"resources":[]}]}`,
+				"nodes entry 0: only one of nodeName or nodeSelector can be set"},
+			{"with an invalid selector", `{"resources":[],"nodes":[{"nodeSelector":{"matchExpressions":[{"key":"nic","operator":"Bogus"}]},"resources":[]}]}`,
+				"nodes entry 0: invalid nodeSelector"},
+			{"with an invalid merged resource", `{"resources":[{"name":"dataplane","lowerDevice":"eth0"}],"nodes":[{"nodeName":"node01","resources":[{"name":"dataplane","selectors":{}}]}]}`,
+				"nodes entry 0: invalid configuration:\nentry 0 (dataplane): only one of lowerDevice, lowerDevices or selectors can be set"},
+			{"with an unknown field", `{"resources":[],"node":[]}`, `unknown field "node"`},
+		}
+		for _, c := range invalid {
+			c := c
+			It("SHOULD reject it "+c.description, func() {
+				_, err := ParseConfig([]byte(c.config))
+				Expect(err).To(MatchError(ContainSubstring(c.message)))
+			})
+		}
+
+		It("SHOULD reject it on every node", func() {
+			_, err := ParseNodeConfig([]byte(`{"resources":[],"nodes":[{"nodeName":"node01","resources":[{"name":"x"}]}]}`), node("node02", nil))
+			Expect(err).To(MatchError(ContainSubstring("nodes entry 0")))
+		})
+	})
+
+	Context("WHEN the node labels change", func() {
+		const config = `{
+			"resources": [{"name": "dataplane", "lowerDevice": "eth0"}],
+			"nodes": [{"nodeSelector": {"matchLabels": {"nic": "ice"}}, "resources": [{"name": "fast", "lowerDevice": "ens2f0"}]}]
+		}`
+
+		var (
+			client       *fake.Clientset
+			stop         chan struct{}
+			pluginListCh chan dpm.PluginNameList
+		)
+
+		setLabels := func(labels map[string]string) {
+			node, err := client.CoreV1().Nodes().Get(context.Background(), "node01", metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			node.Labels = labels
+			_, err = client.CoreV1().Nodes().Update(context.Background(), node, metav1.UpdateOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			client = fake.NewSimpleClientset(&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node01", Labels: map[string]string{"nic": "i40e"}},
+			})
+			stop = make(chan struct{})
+			pluginListCh = make(chan dpm.PluginNameList)
+		})
+
+		AfterEach(func() {
+			close(stop)
+			close(pluginListCh)
+		})
+
+		It("SHOULD notify of the label changes only", func() {
+			changes := (&NodeSource{Name: "node01", Client: client}).watchLabels(stop)
+			Consistently(changes).ShouldNot(Receive())
+
+			setLabels(map[string]string{"nic": "i40e"})
+			Consistently(changes).ShouldNot(Receive())
+
+			setLabels(map[string]string{"nic": "ice"})
+			Eventually(changes).Should(Receive())
+		})
+
+		It("SHOULD not watch without client", func() {
+			Expect((&NodeSource{Name: "node01"}).watchLabels(stop)).To(BeNil())
+			Expect((*NodeSource)(nil).watchLabels(stop)).To(BeNil())
+		})
+
+		It("SHOULD apply the overrides the new labels select", func() {
+			Expect(hasNodeSelectors([]byte(config))).To(BeTrue())
+			ml := NewMacvtapLister("/proc/self/ns/net", ListerTypeConfigEnv)
+			ml.Node = &NodeSource{Name: "node01", Client: client}
+			go ml.followConfig(pluginListCh, "test", []byte(config), nil)
+			Eventually(pluginListCh).Should(Receive(ConsistOf("dataplane")))
+
+			setLabels(map[string]string{"nic": "ice"})
+			Eventually(pluginListCh).Should(Receive(ConsistOf("dataplane", "fast")))
+
+			setLabels(map[string]string{"nic": "i40e"})
+			Eventually(pluginListCh).Should(Receive(ConsistOf("dataplane")))
+		})
+	})
+})
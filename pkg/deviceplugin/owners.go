@@ -0,0 +1,84 @@
+package deviceplugin
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DeviceOwner is the container a device is allocated to.
+type DeviceOwner struct {
+	Namespace string
+	Pod       string
+	Container string
+}
+
+func (o DeviceOwner) String() string {
+	return fmt.Sprintf("%s/%s/%s", o.Namespace, o.Pod, o.Container)
+}
+
+// deviceOwners maps the allocated devices of every resource to their owner, as
+// last reported by the kubelet PodResources API. The device plugin API has no
+// de-allocate flow, so this is the only way to tell which devices are in use,
+// notably after a restart of the plugin.
+type deviceOwners struct {
+	sync.RWMutex
+	owners map[string]map[string]DeviceOwner
+}
+
+var owners = &deviceOwners{owners: make(map[string]map[string]DeviceOwner)}
+
+// update replaces the known owners with the given allocations.
+func (o *deviceOwners) update(devices []containerDevices) {
+	updated := make(map[string]map[string]DeviceOwner)
+	for _, dev := range devices {
+		if updated[dev.ResourceName] == nil {
+			updated[dev.ResourceName] = make(map[string]DeviceOwner)
+		}
+		for _, id := range dev.DeviceIDs {
+			updated[dev.ResourceName][id] = DeviceOwner{
+				Namespace: dev.Namespace,
+				Pod:       dev.Pod,
+				Container: dev.Container,
+			}
+		}
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	o.owners = updated
+}
+
+// ofResource returns the owners of the allocated devices of a resource, by
+// device ID.
+func (o *deviceOwners) ofResource(resourceName string) map[string]DeviceOwner {
+	o.RLock()
+	defer o.RUnlock()
+	owners := make(map[string]DeviceOwner, len(o.owners[resourceName]))
+	for id, owner := range o.owners[resourceName] {
+		owners[id] = owner
+	}
+	return owners
+}
+
+// owner returns the owner of a device of a resource, if allocated.
+func (o *deviceOwners) owner(resourceName, id string) (DeviceOwner, bool) {
+	o.RLock()
+	defer o.RUnlock()
+	owner, ok := o.owners[resourceName][id]
+	return owner, ok
+}
+
+// all returns the owners of the allocated devices of every resource, by
+// resource and device ID.
+func (o *deviceOwners) all() map[string]map[string]DeviceOwner {
+	o.RLock()
+	defer o.RUnlock()
+	all := make(map[string]map[string]DeviceOwner, len(o.owners))
+	for resourceName, owners := range o.owners {
+		all[resourceName] = make(map[string]DeviceOwner, len(owners))
+		for id, owner := range owners {
+			all[resourceName][id] = owner
+		}
+	}
+	return all
+}
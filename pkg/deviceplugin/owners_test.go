@@ -0,0 +1,81 @@
+package deviceplugin
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Allocation recovery", func() {
+	var (
+		server         *fakePodResourcesServer
+		originalSocket string
+		mdp            *macvtapDevicePlugin
+	)
+
+	BeforeEach(func() {
+		server = startFakePodResourcesServer()
+		originalSocket = PodResourcesSocket
+		PodResourcesSocket = server.socket
+
+		mdp = NewMacvtapDevicePlugin(&macvtapConfig{
+			Config: Config{
+				Name:             "dataplane",
+				AllocationPolicy: AllocationPolicyLeastRecentlyUsed,
+			},
+		}, "")
+	})
+
+	AfterEach(func() {
+		PodResourcesSocket = originalSocket
+		server.stop()
+		owners.update(nil)
+	})
+
+	It("SHOULD map the allocated devices to their owner on start", func() {
+		server.setDevices(resourceNamespace+"/dataplane", map[string][]string{
+			"compute": {"dataplaneMvp0", "dataplaneMvp3"},
+		})
+
+		Expect(mdp.Start()).To(Succeed())
+
+		Expect(owners.ofResource(resourceNamespace + "/dataplane")).To(Equal(map[string]DeviceOwner{
+			"dataplaneMvp0": {Namespace: "default", Pod: "virt-launcher", Container: "compute"},
+			"dataplaneMvp3": {Namespace: "default", Pod: "virt-launcher", Container: "compute"},
+		}))
+	})
+
+	It("SHOULD feed the allocated devices to the allocation policy", func() {
+		server.setDevices(resourceNamespace+"/dataplane", map[string][]string{
+			"compute": {"dataplaneMvp0"},
+		})
+
+		Expect(mdp.Start()).To(Succeed())
+
+		// Once released, the recovered device is the most recently used
+		preferred := mdp.allocationPolicy().Preferred([]string{"dataplaneMvp0", "dataplaneMvp1"}, nil, 1)
+		Expect(preferred).To(Equal([]string{"dataplaneMvp1"}))
+	})
+
+	It("SHOULD replace the known owners when recovering again", func() {
+		server.setDevices(resourceNamespace+"/dataplane", map[string][]string{
+			"compute": {"dataplaneMvp0"},
+		})
+		Expect(mdp.recoverAllocations()).To(Succeed())
+
+		server.setDevices(resourceNamespace+"/dataplane", map[string][]string{
+			"compute": {"dataplaneMvp1"},
+		})
+		Expect(mdp.recoverAllocations()).To(Succeed())
+
+		_, owned := owners.owner(resourceNamespace+"/dataplane", "dataplaneMvp0")
+		Expect(owned).To(BeFalse())
+		_, owned = owners.owner(resourceNamespace+"/dataplane", "dataplaneMvp1")
+		Expect(owned).To(BeTrue())
+	})
+
+	It("SHOULD start even when the PodResources API is not available", func() {
+		server.stop()
+		Expect(mdp.Start()).To(Succeed())
+		Expect(mdp.recoverAllocations()).NotTo(Succeed())
+	})
+})
@@ -1,100 +1,292 @@
 package deviceplugin
 
 import (
+	"errors"
 	"fmt"
-	"sort"
+	"strconv"
+	"sync"
 
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 
+	"github.com/kubevirt/macvtap-cni/pkg/devinfo"
 	"github.com/kubevirt/macvtap-cni/pkg/util"
 )
 
 const (
 	tapPath = "/dev/tap"
 	// Interfaces will be named as <Name><suffix>[0-<Capacity>]
-	suffix = "Mvp"
+	suffix = util.DeviceNameInfix
 	// DefaultCapacity is the default when no capacity is provided
 	DefaultCapacity = 100
 	// DefaultMode is the default when no mode is provided
 	DefaultMode = "bridge"
+	// modePassthru is the macvtap mode in which a single macvtap takes over
+	// its lower device
+	modePassthru = "passthru"
 )
 
 type macvtapDevicePlugin struct {
 	*macvtapConfig
-	preferredAllocation bool
 	// NetNsPath is the path to the network namespace the plugin operates in.
 	NetNsPath   string
 	stopWatcher chan struct{}
+	pool        *lowerDevicePool
+
+	// policy is the allocation policy named policyName, which is kept as
+	// long as the configured allocation policy does not change.
+	policyLock sync.Mutex
+	policy     AllocationPolicy
+	policyName string
+
+	createLink func(name, lowerDevice string) (int, error)
+	deleteLink func(name string, index int) error
 }
 
-func NewMacvtapDevicePlugin(config *macvtapConfig, netNsPath string, sort bool) *macvtapDevicePlugin {
-	return &macvtapDevicePlugin{
-		macvtapConfig:       config,
-		preferredAllocation: sort,
-		NetNsPath:           netNsPath,
-		stopWatcher:         make(chan struct{}),
+func NewMacvtapDevicePlugin(config *macvtapConfig, netNsPath string) *macvtapDevicePlugin {
+	mdp := &macvtapDevicePlugin{
+		macvtapConfig: config,
+		NetNsPath:     netNsPath,
+		stopWatcher:   make(chan struct{}),
+		pool:          newLowerDevicePool(),
 	}
+	mdp.createLink = mdp.recreateLink
+	mdp.deleteLink = mdp.deleteLinkWithIndex
+	return mdp
 }
 
-func (mdp *macvtapDevicePlugin) generateMacvtapDevices() []*pluginapi.Device {
+// generateMacvtapDevices returns the devices of the resource, given the health
+// of its lower devices. Each device reports the topology and the health of the
+// lower devices it may be created on.
+func (mdp *macvtapDevicePlugin) generateMacvtapDevices(lowerDevices []string, healthy map[string]bool) []*pluginapi.Device {
 	var macvtapDevs []*pluginapi.Device
 
-	var capacity = mdp.Capacity
-	if capacity <= 0 {
-		capacity = DefaultCapacity
-	}
+	groups := numaGroups(lowerDevices)
+	topologies := make(map[string]*pluginapi.TopologyInfo)
+	for i := 0; i < mdp.capacity(); i++ {
+		candidates := mdp.deviceLowerDevices(i, lowerDevices, groups)
+		health := pluginapi.Unhealthy
+		for _, candidate := range candidates {
+			if healthy[candidate] {
+				health = pluginapi.Healthy
+				break
+			}
+		}
+		// The NUMA node is looked up again on every event as the lower
+		// devices, or the slaves of a bond, may have changed
+		key := fmt.Sprint(candidates)
+		topology, ok := topologies[key]
+		if !ok {
+			topology = topologyInfo(candidates...)
+			topologies[key] = topology
+			glog.V(3).Infof("LowerDevices %v topology: %v", candidates, topology)
+		}
 
-	for i := 0; i < capacity; i++ {
 		name := fmt.Sprint(mdp.Name, suffix, i)
 		macvtapDevs = append(macvtapDevs, &pluginapi.Device{
-			ID:     name,
-			Health: pluginapi.Healthy,
+			ID:       name,
+			Health:   health,
+			Topology: topology,
 		})
 	}
 
 	return macvtapDevs
 }
 
+// deviceLowerDevices returns the lower devices the device of the given index
+// may be created on. The lower devices are assigned to the devices in turn,
+// and a device may be created on the lower devices on the same NUMA nodes as
+// its own, so that it reports the NUMA nodes it is actually created on. In
+// passthru mode, a device is created on its own lower device only. The caller
+// must hold the config lock.
+func (mdp *macvtapDevicePlugin) deviceLowerDevices(index int, lowerDevices []string, groups map[string][]string) []string {
+	if index < 0 || len(lowerDevices) == 0 {
+		return lowerDevices
+	}
+	lowerDevice := lowerDevices[index%len(lowerDevices)]
+	if mdp.Mode == modePassthru {
+		return []string{lowerDevice}
+	}
+	return groups[lowerDevice]
+}
+
+// capacity returns the number of devices of the resource. As a lower device
+// takes a single passthru macvtap, there is at most one device per lower
+// device in passthru mode, and one per lower device by default.
+func (c Config) capacity() int {
+	if c.Mode == modePassthru {
+		if lowerDevices := len(c.lowerDevices()); c.Capacity <= 0 || c.Capacity > lowerDevices {
+			return lowerDevices
+		}
+		return c.Capacity
+	}
+	if c.Capacity <= 0 {
+		return DefaultCapacity
+	}
+	return c.Capacity
+}
+
+// resourceName returns the full name of the resource offered by the plugin.
+func (mdp *macvtapDevicePlugin) resourceName() string {
+	mdp.RLock()
+	defer mdp.RUnlock()
+	return resourceNamespace + "/" + mdp.Name
+}
+
+// deviceType returns the type of the devices, macvtap by default. The caller
+// must hold the config lock.
+func (mdp *macvtapDevicePlugin) deviceType() string {
+	if mdp.Type == "" {
+		return util.TypeMacvtap
+	}
+	return mdp.Type
+}
+
+// allocationPolicy returns the allocation policy configured for the resource,
+// or the lowest-index policy if the configured one is unknown.
+func (mdp *macvtapDevicePlugin) allocationPolicy() AllocationPolicy {
+	mdp.RLock()
+	name, resource := mdp.AllocationPolicy, mdp.Name
+	mdp.RUnlock()
+
+	mdp.policyLock.Lock()
+	defer mdp.policyLock.Unlock()
+	if mdp.policy != nil && mdp.policyName == name {
+		return mdp.policy
+	}
+	policy, ok := NewAllocationPolicy(name)
+	if !ok {
+		glog.Warningf("Unknown allocation policy %q of %s, using %s", name, resource, AllocationPolicyLowestIndex)
+		policy, _ = NewAllocationPolicy(AllocationPolicyLowestIndex)
+	}
+	mdp.policy, mdp.policyName = policy, name
+	return policy
+}
+
+// queues returns the number of queues of the devices, at least one.
+func (mdp *macvtapDevicePlugin) queues() int {
+	mdp.RLock()
+	defer mdp.RUnlock()
+	if mdp.Queues < 1 {
+		return 1
+	}
+	return mdp.Queues
+}
+
+// Start recovers the allocated devices before the plugin registers with the
+// kubelet. Failing to do so does not prevent the plugin from starting.
+func (mdp *macvtapDevicePlugin) Start() error {
+	if err := mdp.recoverAllocations(); err != nil {
+		glog.Warningf("Failed to recover the allocated devices of %s: %v", mdp.resourceName(), err)
+	}
+	return nil
+}
+
+// recoverAllocations learns from the kubelet which devices of the resource are
+// allocated to which containers, and feeds them to the allocation policy.
+func (mdp *macvtapDevicePlugin) recoverAllocations() error {
+	devices, err := listContainerDevices(PodResourcesSocket)
+	if err != nil {
+		return err
+	}
+	owners.update(devices)
+
+	resourceName := mdp.resourceName()
+	allocated := owners.ofResource(resourceName)
+	ids := make([]string, 0, len(allocated))
+	for id, owner := range allocated {
+		glog.V(3).Infof("Device %s of %s is allocated to %s", id, resourceName, owner)
+		ids = append(ids, id)
+	}
+	if len(ids) > 0 {
+		mdp.allocationPolicy().Allocated(ids)
+	}
+	glog.Infof("Recovered %d allocated devices of %s", len(ids), resourceName)
+	return nil
+}
+
 func (mdp *macvtapDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	// Initialize two arrays, one for devices offered when lower device exists,
-	// and no devices if lower device does not exist.
+	// The kubelet opens a new ListAndWatch stream every time the plugin
+	// registers, which happens again whenever the kubelet restarts
+	if err := mdp.recoverAllocations(); err != nil {
+		glog.Warningf("Failed to recover the allocated devices of %s: %v", mdp.resourceName(), err)
+	}
 
+	// Devices are offered up to capacity and their health follows the lower
+	// devices they may be created on: they are Healthy while any of those is
+	// up and has carrier, and Unhealthy otherwise, so that devices allocated
+	// to running pods remain accounted for.
+	// The events of a new watcher may be handled while the previous one stops
+	// and while the devices are reported after an update, so reports are
+	// serialised: a stream must not be sent to concurrently.
+	var reportLock sync.Mutex
+	lastHealthy := -1
 	onLowerDeviceEvent := func() {
+		reportLock.Lock()
+		defer reportLock.Unlock()
 		mdp.RLock()
 		defer mdp.RUnlock()
 
-		doesLowerDeviceExist := false
-		err := ns.WithNetNSPath(mdp.NetNsPath, func(_ ns.NetNS) error {
-			var err error
-			doesLowerDeviceExist, err = util.LinkExists(mdp.LowerDevice)
-			return err
-		})
-		if err != nil {
-			glog.Warningf("Error while checking on lower device %s: %v", mdp.LowerDevice, err)
-			return
+		resourceName := resourceNamespace + "/" + mdp.Name
+		lowerDevices := mdp.lowerDevices()
+		healthyLowerDevices := make(map[string]bool, len(lowerDevices))
+		for _, lowerDevice := range lowerDevices {
+			var healthy bool
+			var reason string
+			err := ns.WithNetNSPath(mdp.NetNsPath, func(_ ns.NetNS) error {
+				var err error
+				healthy, reason, err = util.LowerDeviceHealth(lowerDevice)
+				return err
+			})
+			if err != nil {
+				glog.Warningf("Error while checking on lower device %s: %v", lowerDevice, err)
+				return
+			}
+			if changed, known := mdp.pool.setHealth(lowerDevice, healthy); changed {
+				if known {
+					lowerDeviceTransitions.WithLabelValues(resourceName, lowerDevice, lowerDeviceState(healthy)).Inc()
+				}
+				if healthy {
+					glog.Infof("LowerDevice %s of %s is up", lowerDevice, mdp.Name)
+				} else {
+					glog.Warningf("LowerDevice %s of %s %s", lowerDevice, mdp.Name, reason)
+				}
+			}
+			healthyLowerDevices[lowerDevice] = healthy
+		}
+
+		devices := mdp.generateMacvtapDevices(lowerDevices, healthyLowerDevices)
+		healthy := 0
+		for _, device := range devices {
+			if device.Health == pluginapi.Healthy {
+				healthy++
+			}
 		}
-		var allocatableDevs []*pluginapi.Device
-		if doesLowerDeviceExist {
-			glog.V(3).Infof("LowerDevice %s exists, sending ListAndWatch response with available devices", mdp.LowerDevice)
-			allocatableDevs = mdp.generateMacvtapDevices()
-		} else {
-			glog.V(3).Info("LowerDevice %s does not exist, sending ListAndWatch response with no devices", mdp.LowerDevice)
-			allocatableDevs = make([]*pluginapi.Device, 0)
+		if healthy != lastHealthy {
+			glog.Infof("Reporting %d of %d devices of %s on %v as %s", healthy, len(devices), mdp.Name, lowerDevices, pluginapi.Healthy)
+			lastHealthy = healthy
+		}
+		advertisedDevices.WithLabelValues(resourceName).Set(float64(len(devices)))
+		healthyDevices.WithLabelValues(resourceName).Set(float64(healthy))
+
+		if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err == nil {
+			mdp.listed.Store(true)
 		}
-		_ = s.Send(&pluginapi.ListAndWatchResponse{Devices: allocatableDevs})
 	}
 
 loop:
 	stopCh := make(chan struct{})
-	// Listen for events of lower device interface. On any, check if lower
-	// device exists. If it does, offer up to capacity macvtap devices. Do
-	// not offer any otherwise.
+	// Listen for events of lower device interfaces. On any, check their
+	// health and report the devices accordingly.
 
+	mdp.RLock()
+	lowerDevices := mdp.lowerDevices()
+	mdp.RUnlock()
 	go util.OnLinkEvent(
-		mdp.LowerDevice,
+		lowerDevices,
 		mdp.NetNsPath,
 		onLowerDeviceEvent,
 		stopCh,
@@ -110,70 +302,223 @@ loop:
 			goto loop
 		case <-mdp.stopWatcher:
 			close(stopCh)
-			glog.Warningf("Stop device plugin name: %s, lowerDevice: %s", mdp.Name, mdp.LowerDevice)
+			mdp.listed.Store(false)
+			forgetResource(mdp.resourceName())
+			glog.Warningf("Stop device plugin name: %s, lowerDevices: %v", mdp.Name, lowerDevices)
 			return nil
 		}
 	}
 }
 
-func (mdp *macvtapDevicePlugin) Allocate(ctx context.Context, r *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+// pickLowerDevice returns the lower device to create a device on, out of those
+// the device may be created on, counting as used the ones picked for the other
+// devices being allocated.
+func (mdp *macvtapDevicePlugin) pickLowerDevice(deviceID string, picked map[string]int) string {
+	resourceName := mdp.resourceName()
+	mdp.RLock()
+	lowerDevices := mdp.lowerDevices()
+	candidates, strategy := mdp.deviceLowerDevices(deviceIndex(deviceID), lowerDevices, numaGroups(lowerDevices)), mdp.LowerDeviceStrategy
+	mdp.RUnlock()
+	return mdp.pool.pick(candidates, strategy, func() map[string]int {
+		used := usedLowerDevices(resourceName)
+		for lowerDevice, count := range picked {
+			used[lowerDevice] += count
+		}
+		return used
+	})
+}
+
+func (mdp *macvtapDevicePlugin) Allocate(ctx context.Context, r *pluginapi.AllocateRequest) (response *pluginapi.AllocateResponse, err error) {
+	resourceName := mdp.resourceName()
+	allocations.WithLabelValues(resourceName).Inc()
+	timer := prometheus.NewTimer(allocationDuration.WithLabelValues(resourceName))
+	defer func() {
+		timer.ObserveDuration()
+		if err != nil {
+			allocationFailures.WithLabelValues(resourceName).Inc()
+		}
+	}()
+
+	return mdp.allocate(r)
+}
+
+// allocateConcurrency is the number of devices created at once by Allocate.
+const allocateConcurrency = 8
+
+// deviceCreation is a device created for an Allocate call, on lowerDevice.
+type deviceCreation struct {
+	name        string
+	lowerDevice string
+	index       int
+	err         error
+}
+
+// allocate creates the devices of every container of the request, or none:
+// should any fail to be created, those created are deleted and the errors of
+// all are returned.
+func (mdp *macvtapDevicePlugin) allocate(r *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
 	glog.Infoln("assign macvtap network devices: ", &r.ContainerRequests)
-	var response pluginapi.AllocateResponse
+	resourceName := mdp.resourceName()
 
-	for _, req := range r.ContainerRequests {
-		var devices []*pluginapi.DeviceSpec
+	// Lower devices are picked in order, accounting for those picked for the
+	// previous devices of the request
+	picked := make(map[string]int)
+	creations := make([][]*deviceCreation, len(r.ContainerRequests))
+	for i, req := range r.ContainerRequests {
 		for _, name := range req.DevicesIDs {
-			dev := new(pluginapi.DeviceSpec)
-
-			// There is a possibility the interface already exists from a
-			// previous allocation. In a typical scenario, macvtap interfaces
-			// would be deleted by the CNI when healthy pod sandbox is
-			// terminated. But on occasions, sandbox allocations may fail and
-			// the interface is left lingering. The device plugin framework has
-			// no de-allocate flow to clean up. So we attempt to delete a
-			// possibly existing existing interface before creating it to reset
-			// its state.
-			var index int
-			err := ns.WithNetNSPath(mdp.NetNsPath, func(_ ns.NetNS) error {
-				mdp.RLock()
-				defer mdp.RUnlock()
-				var err error
-				glog.Infoln("create macvtap link ", "deviceName:", name, ",lowerDeviceName:", mdp.LowerDevice, ",mode:", mdp.Mode)
-				index, err = util.RecreateMacvtap(name, mdp.LowerDevice, mdp.Mode)
-				return err
-			})
-			if err != nil {
-				glog.Errorf("create macvtap link failed: %v", err)
-				return nil, err
+			lowerDevice := mdp.pickLowerDevice(name, picked)
+			picked[lowerDevice]++
+			creations[i] = append(creations[i], &deviceCreation{name: name, lowerDevice: lowerDevice})
+		}
+	}
+
+	// There is a possibility the interface already exists from a previous
+	// allocation. In a typical scenario, macvtap interfaces would be deleted
+	// by the CNI when healthy pod sandbox is terminated. But on occasions,
+	// sandbox allocations may fail and the interface is left lingering. The
+	// device plugin framework has no de-allocate flow to clean up. So we
+	// attempt to delete a possibly existing existing interface before
+	// creating it to reset its state.
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, allocateConcurrency)
+	for _, containerCreations := range creations {
+		for _, c := range containerCreations {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(c *deviceCreation) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				c.index, c.err = mdp.createLink(c.name, c.lowerDevice)
+			}(c)
+		}
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, containerCreations := range creations {
+		for _, c := range containerCreations {
+			if c.err != nil {
+				glog.Errorf("create link %s failed: %v", c.name, c.err)
+				recreateFailures.WithLabelValues(resourceName).Inc()
+				errs = append(errs, fmt.Errorf("device %s: %v", c.name, c.err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		mdp.rollback(resourceName, creations)
+		return nil, fmt.Errorf("failed to allocate devices of %s:\n%w", resourceName, errors.Join(errs...))
+	}
+
+	mdp.RLock()
+	deviceType, mode, queues := mdp.deviceType(), mdp.Mode, mdp.Queues
+	mdp.RUnlock()
+	var response pluginapi.AllocateResponse
+	for i, req := range r.ContainerRequests {
+		var devices []*pluginapi.DeviceSpec
+		for _, c := range creations[i] {
+			info := &devinfo.DeviceInfo{
+				Type:    deviceType,
+				Version: devinfo.Version,
+				Tap: &devinfo.TapDevice{
+					Path:        fmt.Sprint(tapPath, c.index),
+					IfIndex:     c.index,
+					LowerDevice: c.lowerDevice,
+					Mode:        mode,
+					Queues:      queues,
+				},
+			}
+			// Publishing the device information is best effort, consumers
+			// fall back to the device specs
+			if err := devinfo.SaveForDP(resourceName, c.name, info); err != nil {
+				glog.Errorf("save device info of %s failed: %v", c.name, err)
 			}
 			// 在宿主机上创建的macvtap设备分配给容器/授予权限
 			// 下一步将在容器启动调用cni时将其设备命名空间移动到容器下
-			devPath := fmt.Sprint(tapPath, index)
-			dev.HostPath = devPath
-			dev.ContainerPath = devPath
-			dev.Permissions = "rw"
-			devices = append(devices, dev)
+			devPath := fmt.Sprint(tapPath, c.index)
+			devices = append(devices, &pluginapi.DeviceSpec{
+				HostPath:      devPath,
+				ContainerPath: devPath,
+				Permissions:   "rw",
+			})
 		}
-		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerAllocateResponse{
+		mdp.allocationPolicy().Allocated(req.DevicesIDs)
+		containerResponse := &pluginapi.ContainerAllocateResponse{
 			Devices: devices,
-		})
+		}
+		if queues := mdp.queues(); queues > 1 {
+			containerResponse.Annotations = map[string]string{
+				fmt.Sprintf("%s/%s.queues", resourceNamespace, mdp.Name): strconv.Itoa(queues),
+			}
+		}
+		response.ContainerResponses = append(response.ContainerResponses, containerResponse)
 	}
 	glog.Infoln("network device allocation successful: ", &response.ContainerResponses)
 	return &response, nil
 }
 
+// rollback deletes the devices created for a failed Allocate call, along with
+// the information published for them by a previous allocation, their links
+// having been replaced.
+func (mdp *macvtapDevicePlugin) rollback(resourceName string, creations [][]*deviceCreation) {
+	for _, containerCreations := range creations {
+		for _, c := range containerCreations {
+			if c.err != nil {
+				continue
+			}
+			glog.Infof("delete link %s created for the failed allocation", c.name)
+			if err := mdp.deleteLink(c.name, c.index); err != nil {
+				glog.Errorf("delete link %s failed: %v", c.name, err)
+			}
+			if err := devinfo.CleanForDP(resourceName, c.name); err != nil {
+				glog.Warningf("remove device info of %s failed: %v", c.name, err)
+			}
+		}
+	}
+}
+
+// recreateLink creates the link of a device on the lower device, deleting
+// the link of the same name if any, and returns its index.
+func (mdp *macvtapDevicePlugin) recreateLink(name, lowerDevice string) (int, error) {
+	var index int
+	err := ns.WithNetNSPath(mdp.NetNsPath, func(_ ns.NetNS) error {
+		mdp.RLock()
+		defer mdp.RUnlock()
+		var err error
+		recreate := util.RecreateMacvtap
+		if mdp.Type == util.TypeIPVtap {
+			recreate = util.RecreateIPVtap
+		}
+		glog.Infoln("create", mdp.deviceType(), "link ", "deviceName:", name, ",lowerDeviceName:", lowerDevice, ",mode:", mdp.Mode, ",queues:", mdp.Queues)
+		index, err = recreate(name, lowerDevice, mdp.Mode, mdp.Queues)
+		return err
+	})
+	return index, err
+}
+
+// deleteLinkWithIndex deletes the link of a device if it still has the given
+// index.
+func (mdp *macvtapDevicePlugin) deleteLinkWithIndex(name string, index int) error {
+	return ns.WithNetNSPath(mdp.NetNsPath, func(_ ns.NetNS) error {
+		_, err := util.DeleteMacvtapWithIndex(name, index)
+		return err
+	})
+}
+
 func (mdp *macvtapDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
 	return nil, nil
 }
 
 func (mdp *macvtapDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
 	return &pluginapi.DevicePluginOptions{
-		GetPreferredAllocationAvailable: mdp.preferredAllocation,
+		GetPreferredAllocationAvailable: true,
 	}, nil
 }
 
 func (mdp *macvtapDevicePlugin) GetPreferredAllocation(_ context.Context, req *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
 	glog.Infoln("Into GetPreferredAllocation: ", &req.ContainerRequests)
+	policy := mdp.allocationPolicy()
 	response := make([]*pluginapi.ContainerPreferredAllocationResponse, len(req.ContainerRequests))
 	resp := &pluginapi.PreferredAllocationResponse{
 		ContainerResponses: response,
@@ -183,9 +528,8 @@ func (mdp *macvtapDevicePlugin) GetPreferredAllocation(_ context.Context, req *p
 		glog.V(3).Infoln("current container[", i, "] request AvailableDeviceIDs: ", availableDeviceIDs)
 		glog.V(3).Infoln("current container[", i, "] request MustIncludeDeviceIDs: ", request.GetMustIncludeDeviceIDs())
 		glog.V(3).Infoln("current container[", i, "] request AllocationSize: ", request.GetAllocationSize())
-		sort.Strings(availableDeviceIDs)
 		response[i] = &pluginapi.ContainerPreferredAllocationResponse{
-			DeviceIDs: availableDeviceIDs[0:request.GetAllocationSize()],
+			DeviceIDs: policy.Preferred(availableDeviceIDs, request.GetMustIncludeDeviceIDs(), int(request.GetAllocationSize())),
 		}
 	}
 	return resp, nil
@@ -3,35 +3,56 @@ package deviceplugin
 import (
 	"fmt"
 	"math/rand"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
 	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/metadata"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 
+	"github.com/kubevirt/macvtap-cni/pkg/devinfo"
 	"github.com/kubevirt/macvtap-cni/pkg/util"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 type ListAndWatchServerSendSpy struct {
+	sync.Mutex
 	calls int
 	last  *pluginapi.ListAndWatchResponse
 }
 
 // Records that update has been received and fails or not depending on the fake server configuration.
 func (s *ListAndWatchServerSendSpy) Send(resp *pluginapi.ListAndWatchResponse) error {
+	s.Lock()
+	defer s.Unlock()
 	s.calls++
 	s.last = resp
 	return nil
 }
 
+// healths returns the health of the devices in the last update received.
+func (s *ListAndWatchServerSendSpy) healths() []string {
+	s.Lock()
+	defer s.Unlock()
+	if s.last == nil {
+		return nil
+	}
+	var healths []string
+	for _, dev := range s.last.Devices {
+		healths = append(healths, dev.Health)
+	}
+	return healths
+}
+
 // Mandatory to implement pluginapi.DevicePlugin_ListAndWatchServer
 func (s *ListAndWatchServerSendSpy) Context() context.Context {
 	return nil
@@ -99,7 +120,7 @@ var _ = Describe("Macvtap", func() {
 				},
 				update: make(chan struct{}),
 			}
-			mvdp = NewMacvtapDevicePlugin(config, testNs.Path(), false)
+			mvdp = NewMacvtapDevicePlugin(config, testNs.Path())
 			sendSpy = &ListAndWatchServerSendSpy{}
 			go func() {
 				err := mvdp.ListAndWatch(nil, sendSpy)
@@ -111,6 +132,31 @@ var _ = Describe("Macvtap", func() {
 			mvdp.(dpm.PluginInterfaceStop).Stop()
 		})
 
+		It("should report device health following the lower device state", func() {
+			By("reporting devices unhealthy while the lower device is down", func() {
+				Eventually(sendSpy.healths).ShouldNot(BeEmpty())
+				Expect(sendSpy.healths()).To(HaveEach(pluginapi.Unhealthy))
+			})
+
+			By("reporting devices healthy once the lower device is up", func() {
+				err := testNs.Do(func(ns ns.NetNS) error {
+					return netlink.LinkSetUp(lowerDeviceIface)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(sendSpy.healths).Should(HaveEach(pluginapi.Healthy))
+				Expect(sendSpy.healths()).To(HaveLen(DefaultCapacity))
+			})
+
+			By("reporting devices unhealthy again once the lower device is down", func() {
+				err := testNs.Do(func(ns ns.NetNS) error {
+					return netlink.LinkSetDown(lowerDeviceIface)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(sendSpy.healths).Should(HaveEach(pluginapi.Unhealthy))
+				Expect(sendSpy.healths()).To(HaveLen(DefaultCapacity))
+			})
+		})
+
 		It("should allocate a new device upon request", func() {
 			ifaceName := lowerDeviceIfaceName + "Mvp99"
 			req := &pluginapi.AllocateRequest{
@@ -141,14 +187,123 @@ var _ = Describe("Macvtap", func() {
 			Expect(dev.HostPath).To(Equal(dev.ContainerPath))
 		})
 
+		It("should publish the device info of the allocated device", func() {
+			dpDir, err := os.MkdirTemp("", "devinfo")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dpDir)
+			originalDPDir := devinfo.DPDir
+			devinfo.DPDir = dpDir
+			defer func() { devinfo.DPDir = originalDPDir }()
+
+			ifaceName := lowerDeviceIfaceName + "Mvp98"
+			req := &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+					{
+						DevicesIDs: []string{
+							ifaceName,
+						},
+					},
+				},
+			}
+
+			res, err := mvdp.Allocate(nil, req)
+			Expect(err).NotTo(HaveOccurred())
+
+			info, err := devinfo.LoadForDP(resourceNamespace+"/"+lowerDeviceIfaceName, ifaceName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info).NotTo(BeNil())
+			Expect(info.Type).To(Equal(util.TypeMacvtap))
+			Expect(info.Tap.Path).To(Equal(res.ContainerResponses[0].Devices[0].ContainerPath))
+			Expect(info.Tap.LowerDevice).To(Equal(lowerDeviceIfaceName))
+			Expect(info.Tap.Mode).To(Equal("bridge"))
+		})
+
+		It("should allocate a multiqueue device when queues are configured", func() {
+			config := &macvtapConfig{
+				Config: Config{
+					Name:        lowerDeviceIfaceName,
+					LowerDevice: lowerDeviceIfaceName,
+					Mode:        "bridge",
+					Queues:      4,
+				},
+				update: make(chan struct{}),
+			}
+			multiqueueDp := NewMacvtapDevicePlugin(config, testNs.Path())
+
+			ifaceName := lowerDeviceIfaceName + "Mvp98"
+			req := &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+					{
+						DevicesIDs: []string{
+							ifaceName,
+						},
+					},
+				},
+			}
+
+			res, err := multiqueueDp.Allocate(nil, req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.ContainerResponses[0].Annotations).To(HaveKeyWithValue(resourceNamespace+"/"+lowerDeviceIfaceName+".queues", "4"))
+
+			var iface netlink.Link
+			err = testNs.Do(func(ns ns.NetNS) error {
+				var err error
+				iface, err = netlink.LinkByName(ifaceName)
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(iface.Attrs().NumTxQueues).To(Equal(4))
+		})
+
+		It("should allocate an ipvtap device when the ipvtap type is configured", func() {
+			config := &macvtapConfig{
+				Config: Config{
+					Name:        lowerDeviceIfaceName,
+					LowerDevice: lowerDeviceIfaceName,
+					Mode:        "l3",
+					Type:        "ipvtap",
+				},
+				update: make(chan struct{}),
+			}
+			ipvtapDp := NewMacvtapDevicePlugin(config, testNs.Path())
+
+			ifaceName := lowerDeviceIfaceName + "Mvp97"
+			req := &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+					{
+						DevicesIDs: []string{
+							ifaceName,
+						},
+					},
+				},
+			}
+
+			res, err := ipvtapDp.Allocate(nil, req)
+			Expect(err).NotTo(HaveOccurred())
+
+			var iface netlink.Link
+			err = testNs.Do(func(ns ns.NetNS) error {
+				var err error
+				iface, err = netlink.LinkByName(ifaceName)
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(iface.Type()).To(Equal("ipvtap"))
+			Expect(iface.(*netlink.IPVtap).Mode).To(Equal(netlink.IPVLAN_MODE_L3))
+
+			dev := res.ContainerResponses[0].Devices[0]
+			Expect(dev.ContainerPath).To(Equal(tapPath + strconv.Itoa(iface.Attrs().Index)))
+		})
+
 		Context("when lower device does not exist", func() {
-			It("should not advertise devices", func() {
+			It("should advertise the devices as unhealthy", func() {
 				By("first advertising healthy devices", func() {
-					Eventually(func() int {
-						return sendSpy.calls
-					}).Should(Equal(1))
-
-					Expect(sendSpy.last.Devices).To(HaveLen(100))
+					err := testNs.Do(func(ns ns.NetNS) error {
+						return netlink.LinkSetUp(lowerDeviceIface)
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Eventually(sendSpy.healths).Should(HaveEach(pluginapi.Healthy))
+					Expect(sendSpy.healths()).To(HaveLen(DefaultCapacity))
 				})
 
 				By("then deleting the lower device", func() {
@@ -158,12 +313,9 @@ var _ = Describe("Macvtap", func() {
 					Expect(err).NotTo(HaveOccurred())
 				})
 
-				By("then no longer advertising devices", func() {
-					Eventually(func() int {
-						return sendSpy.calls
-					}).Should(Equal(2))
-
-					Expect(sendSpy.last.Devices).To(HaveLen(0))
+				By("then advertising the devices as unhealthy", func() {
+					Eventually(sendSpy.healths).Should(HaveEach(pluginapi.Unhealthy))
+					Expect(sendSpy.healths()).To(HaveLen(DefaultCapacity))
 				})
 			})
 		})
@@ -269,3 +421,200 @@ var _ = Describe("Macvtap", func() {
 		})
 	})
 })
+
+var _ = Describe("Lower device health", func() {
+	dummy := func(flags net.Flags, rawFlags uint32, operState netlink.LinkOperState) netlink.Link {
+		return &netlink.Dummy{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:      "lowerdev",
+				Flags:     flags,
+				RawFlags:  rawFlags,
+				OperState: operState,
+			},
+		}
+	}
+
+	It("should be healthy when up with carrier", func() {
+		healthy, reason := util.LinkHealth(dummy(net.FlagUp, unix.IFF_UP|unix.IFF_LOWER_UP, netlink.OperUp))
+		Expect(healthy).To(BeTrue())
+		Expect(reason).To(BeEmpty())
+	})
+
+	It("should be healthy when up with carrier and an unknown operational state", func() {
+		healthy, _ := util.LinkHealth(dummy(net.FlagUp, unix.IFF_UP|unix.IFF_LOWER_UP, netlink.OperUnknown))
+		Expect(healthy).To(BeTrue())
+	})
+
+	It("should be unhealthy when administratively down", func() {
+		healthy, reason := util.LinkHealth(dummy(0, 0, netlink.OperDown))
+		Expect(healthy).To(BeFalse())
+		Expect(reason).To(ContainSubstring("administratively down"))
+	})
+
+	It("should be unhealthy when operationally down", func() {
+		healthy, reason := util.LinkHealth(dummy(net.FlagUp, unix.IFF_UP, netlink.OperLowerLayerDown))
+		Expect(healthy).To(BeFalse())
+		Expect(reason).To(ContainSubstring("lower-layer-down"))
+	})
+
+	It("should be unhealthy without carrier", func() {
+		healthy, reason := util.LinkHealth(dummy(net.FlagUp, unix.IFF_UP, netlink.OperUnknown))
+		Expect(healthy).To(BeFalse())
+		Expect(reason).To(ContainSubstring("no carrier"))
+	})
+})
+
+var _ = Describe("Allocate", func() {
+	var (
+		mdp           *macvtapDevicePlugin
+		originalDPDir string
+		lock          sync.Mutex
+		created       map[string]int
+		lowerDevices  map[string]string
+		deleted       []string
+		failing       map[string]bool
+	)
+
+	BeforeEach(func() {
+		originalDPDir = devinfo.DPDir
+		dpDir, err := os.MkdirTemp("", "devinfo")
+		Expect(err).NotTo(HaveOccurred())
+		devinfo.DPDir = dpDir
+
+		created = make(map[string]int)
+		lowerDevices = make(map[string]string)
+		deleted = nil
+		failing = make(map[string]bool)
+		mdp = NewMacvtapDevicePlugin(&macvtapConfig{
+			Config: Config{Name: "dataplane", LowerDevices: []string{"eth0", "eth1"}, LowerDeviceStrategy: LowerDeviceStrategyLeastUsed},
+		}, "")
+		mdp.createLink = func(name, lowerDevice string) (int, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			if failing[name] {
+				return 0, fmt.Errorf("no space left on device")
+			}
+			index := 10 + len(created)
+			created[name] = index
+			lowerDevices[name] = lowerDevice
+			return index, nil
+		}
+		mdp.deleteLink = func(name string, index int) error {
+			lock.Lock()
+			defer lock.Unlock()
+			Expect(created).To(HaveKeyWithValue(name, index))
+			deleted = append(deleted, name)
+			return nil
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(devinfo.DPDir)
+		devinfo.DPDir = originalDPDir
+	})
+
+	request := func(containers ...[]string) *pluginapi.AllocateRequest {
+		req := &pluginapi.AllocateRequest{}
+		for _, ids := range containers {
+			req.ContainerRequests = append(req.ContainerRequests, &pluginapi.ContainerAllocateRequest{DevicesIDs: ids})
+		}
+		return req
+	}
+
+	It("SHOULD create the devices of every container", func() {
+		res, err := mdp.Allocate(context.Background(), request(
+			[]string{"dataplaneMvp0", "dataplaneMvp1"},
+			[]string{"dataplaneMvp2"},
+		))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.ContainerResponses).To(HaveLen(2))
+		Expect(res.ContainerResponses[0].Devices).To(HaveLen(2))
+		Expect(res.ContainerResponses[1].Devices).To(ConsistOf(&pluginapi.DeviceSpec{
+			HostPath:      fmt.Sprint(tapPath, created["dataplaneMvp2"]),
+			ContainerPath: fmt.Sprint(tapPath, created["dataplaneMvp2"]),
+			Permissions:   "rw",
+		}))
+		Expect(created).To(HaveLen(3))
+		Expect(deleted).To(BeEmpty())
+
+		By("spreading the devices of the request over the lower devices", func() {
+			Expect(usedLowerDevices(resourceNamespace + "/dataplane")).To(Equal(map[string]int{"eth0": 2, "eth1": 1}))
+		})
+	})
+
+	It("SHOULD give each passthru device a lower device of its own", func() {
+		mdp.Mode = "passthru"
+		Expect(mdp.capacity()).To(Equal(2))
+		Expect(mdp.generateMacvtapDevices(mdp.lowerDevices(), nil)).To(HaveLen(2))
+
+		_, err := mdp.Allocate(context.Background(), request([]string{"dataplaneMvp1"}, []string{"dataplaneMvp0"}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lowerDevices).To(Equal(map[string]string{"dataplaneMvp0": "eth0", "dataplaneMvp1": "eth1"}))
+	})
+
+	It("SHOULD offer at most one passthru device per lower device", func() {
+		mdp.Mode = "passthru"
+		mdp.Capacity = 10
+		Expect(mdp.capacity()).To(Equal(2))
+		mdp.Capacity = 1
+		Expect(mdp.capacity()).To(Equal(1))
+	})
+
+	It("SHOULD delete the devices created when any fails", func() {
+		failing["dataplaneMvp1"] = true
+		failing["dataplaneMvp3"] = true
+
+		_, err := mdp.Allocate(context.Background(), request(
+			[]string{"dataplaneMvp0", "dataplaneMvp1"},
+			[]string{"dataplaneMvp2", "dataplaneMvp3"},
+		))
+		Expect(err).To(MatchError(And(
+			ContainSubstring("failed to allocate devices of "+resourceNamespace+"/dataplane"),
+			ContainSubstring("device dataplaneMvp1: no space left on device"),
+			ContainSubstring("device dataplaneMvp3: no space left on device"),
+		)))
+		Expect(deleted).To(ConsistOf("dataplaneMvp0", "dataplaneMvp2"))
+
+		By("removing the device information of the deleted devices", func() {
+			Expect(usedLowerDevices(resourceNamespace + "/dataplane")).To(BeEmpty())
+		})
+	})
+
+	It("SHOULD create the devices of a large request concurrently", func() {
+		var ids []string
+		for i := 0; i < 4*allocateConcurrency; i++ {
+			ids = append(ids, fmt.Sprint("dataplaneMvp", i))
+		}
+		var running, maxRunning int
+		release := make(chan struct{})
+		create := mdp.createLink
+		mdp.createLink = func(name, lowerDevice string) (int, error) {
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+			<-release
+			lock.Lock()
+			running--
+			lock.Unlock()
+			return create(name, lowerDevice)
+		}
+
+		done := make(chan error)
+		go func() {
+			_, err := mdp.Allocate(context.Background(), request(ids))
+			done <- err
+		}()
+		Eventually(func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return running
+		}).Should(Equal(allocateConcurrency))
+		close(release)
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(maxRunning).To(Equal(allocateConcurrency))
+		Expect(created).To(HaveLen(len(ids)))
+	})
+})
@@ -0,0 +1,58 @@
+package deviceplugin
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// PodResourcesSocket is the socket of the kubelet PodResources API, which
+// tells the devices allocated to the containers of the node.
+var PodResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+const podResourcesTimeout = 10 * time.Second
+
+// containerDevices are the devices of a resource allocated to a container.
+type containerDevices struct {
+	Namespace    string
+	Pod          string
+	Container    string
+	ResourceName string
+	DeviceIDs    []string
+}
+
+// listContainerDevices returns the devices allocated to the containers of the
+// node, as reported by the PodResources API at the given socket.
+func listContainerDevices(socket string) ([]containerDevices, error) {
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), podResourcesTimeout)
+	defer cancel()
+	resp, err := podresourcesapi.NewPodResourcesListerClient(conn).List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []containerDevices
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, dev := range container.GetDevices() {
+				devices = append(devices, containerDevices{
+					Namespace:    pod.GetNamespace(),
+					Pod:          pod.GetName(),
+					Container:    container.GetName(),
+					ResourceName: dev.GetResourceName(),
+					DeviceIDs:    dev.GetDeviceIds(),
+				})
+			}
+		}
+	}
+	return devices, nil
+}
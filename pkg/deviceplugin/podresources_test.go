@@ -0,0 +1,102 @@
+package deviceplugin
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakePodResourcesServer serves the PodResources API on a unix socket with
+// the configured pods.
+type fakePodResourcesServer struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+	sync.Mutex
+	pods   []*podresourcesapi.PodResources
+	socket string
+	server *grpc.Server
+	dir    string
+}
+
+func startFakePodResourcesServer() *fakePodResourcesServer {
+	dir, err := os.MkdirTemp("", "podresources")
+	Expect(err).NotTo(HaveOccurred())
+	f := &fakePodResourcesServer{
+		socket: filepath.Join(dir, "kubelet.sock"),
+		server: grpc.NewServer(),
+		dir:    dir,
+	}
+	listener, err := net.Listen("unix", f.socket)
+	Expect(err).NotTo(HaveOccurred())
+	podresourcesapi.RegisterPodResourcesListerServer(f.server, f)
+	go f.server.Serve(listener)
+	return f
+}
+
+func (f *fakePodResourcesServer) stop() {
+	f.server.Stop()
+	os.RemoveAll(f.dir)
+}
+
+// setDevices makes the server report a pod with a container per entry of
+// containers, each owning the given devices of the resource.
+func (f *fakePodResourcesServer) setDevices(resourceName string, containers map[string][]string) {
+	f.Lock()
+	defer f.Unlock()
+	pod := &podresourcesapi.PodResources{Name: "virt-launcher", Namespace: "default"}
+	for name, ids := range containers {
+		pod.Containers = append(pod.Containers, &podresourcesapi.ContainerResources{
+			Name: name,
+			Devices: []*podresourcesapi.ContainerDevices{
+				{ResourceName: resourceName, DeviceIds: ids},
+			},
+		})
+	}
+	f.pods = []*podresourcesapi.PodResources{pod}
+}
+
+func (f *fakePodResourcesServer) List(context.Context, *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: f.pods}, nil
+}
+
+var _ = Describe("PodResources", func() {
+	var server *fakePodResourcesServer
+
+	BeforeEach(func() {
+		server = startFakePodResourcesServer()
+	})
+
+	AfterEach(func() {
+		server.stop()
+	})
+
+	It("SHOULD list the devices allocated to containers", func() {
+		server.setDevices(resourceNamespace+"/dataplane", map[string][]string{
+			"compute": {"dataplaneMvp1", "dataplaneMvp2"},
+		})
+
+		devices, err := listContainerDevices(server.socket)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(devices).To(ConsistOf(containerDevices{
+			Namespace:    "default",
+			Pod:          "virt-launcher",
+			Container:    "compute",
+			ResourceName: resourceNamespace + "/dataplane",
+			DeviceIDs:    []string{"dataplaneMvp1", "dataplaneMvp2"},
+		}))
+	})
+
+	It("SHOULD fail when the API is not available", func() {
+		_, err := listContainerDevices(filepath.Join(server.dir, "missing.sock"))
+		Expect(err).To(HaveOccurred())
+	})
+})
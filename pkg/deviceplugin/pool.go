@@ -0,0 +1,120 @@
+package deviceplugin
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+
+	"github.com/kubevirt/macvtap-cni/pkg/devinfo"
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+const (
+	// LowerDeviceStrategyRoundRobin picks the healthy lower devices in turn.
+	// It is the default.
+	LowerDeviceStrategyRoundRobin = "round-robin"
+	// LowerDeviceStrategyLeastUsed picks the healthy lower device with the
+	// fewest allocated devices.
+	LowerDeviceStrategyLeastUsed = "least-used"
+	// LowerDeviceStrategyFirstHealthy picks the first healthy lower device in
+	// the configured order, so that the others serve as fallback.
+	LowerDeviceStrategyFirstHealthy = "first-healthy"
+)
+
+// lowerDevices returns the lower devices backing the resource: LowerDevices if
+// set, LowerDevice otherwise.
+func (c Config) lowerDevices() []string {
+	if len(c.LowerDevices) > 0 {
+		return c.LowerDevices
+	}
+	return []string{c.LowerDevice}
+}
+
+// lowerDevicePool picks the lower device of each allocated device out of the
+// lower devices of a resource.
+type lowerDevicePool struct {
+	sync.Mutex
+	// healthy tells the last known health of each lower device. Lower devices
+	// of unknown health are considered healthy.
+	healthy map[string]bool
+	next    int
+}
+
+func newLowerDevicePool() *lowerDevicePool {
+	return &lowerDevicePool{healthy: make(map[string]bool)}
+}
+
+// setHealth records the health of a lower device and reports whether it
+// changed, and whether it was known before, that is whether the change is a
+// transition rather than the initial health.
+func (p *lowerDevicePool) setHealth(lowerDevice string, healthy bool) (changed, known bool) {
+	p.Lock()
+	defer p.Unlock()
+	previous, known := p.healthy[lowerDevice]
+	p.healthy[lowerDevice] = healthy
+	return !known || previous != healthy, known
+}
+
+// candidates returns the healthy lower devices out of the given ones, or all
+// of them if none is healthy.
+func (p *lowerDevicePool) candidates(lowerDevices []string) []string {
+	var healthy []string
+	for _, lowerDevice := range lowerDevices {
+		if h, known := p.healthy[lowerDevice]; !known || h {
+			healthy = append(healthy, lowerDevice)
+		}
+	}
+	if len(healthy) == 0 {
+		return lowerDevices
+	}
+	return healthy
+}
+
+// pick returns the lower device to create a device on, according to the
+// strategy. used returns the number of allocated devices per lower device.
+func (p *lowerDevicePool) pick(lowerDevices []string, strategy string, used func() map[string]int) string {
+	if len(lowerDevices) == 1 {
+		return lowerDevices[0]
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	candidates := p.candidates(lowerDevices)
+	switch strategy {
+	case LowerDeviceStrategyFirstHealthy:
+		return candidates[0]
+	case LowerDeviceStrategyLeastUsed:
+		counts := used()
+		picked := candidates[0]
+		for _, candidate := range candidates[1:] {
+			if counts[candidate] < counts[picked] {
+				picked = candidate
+			}
+		}
+		return picked
+	default:
+		if strategy != "" && strategy != LowerDeviceStrategyRoundRobin {
+			glog.Warningf("Unknown lower device strategy %q, using %s", strategy, LowerDeviceStrategyRoundRobin)
+		}
+		picked := candidates[p.next%len(candidates)]
+		p.next++
+		return picked
+	}
+}
+
+// usedLowerDevices counts the allocated devices of a resource per lower device,
+// from the device information published on allocation.
+func usedLowerDevices(resourceName string) map[string]int {
+	infos, err := devinfo.ListForDP(resourceName)
+	if err != nil {
+		glog.Warningf("Failed to list the allocated devices of %s: %v", resourceName, err)
+	}
+	counts := make(map[string]int)
+	for deviceID, info := range infos {
+		if util.ResourceNameFromDevice(deviceID) != resourceName || info.Tap == nil {
+			continue
+		}
+		counts[info.Tap.LowerDevice]++
+	}
+	return counts
+}
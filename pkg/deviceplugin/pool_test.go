@@ -0,0 +1,109 @@
+package deviceplugin
+
+import (
+	"os"
+
+	"github.com/kubevirt/macvtap-cni/pkg/devinfo"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lower device pool", func() {
+	lowerDevices := []string{"eth0", "eth1", "eth2"}
+	noneUsed := func() map[string]int { return nil }
+
+	var pool *lowerDevicePool
+
+	BeforeEach(func() {
+		pool = newLowerDevicePool()
+	})
+
+	pickN := func(strategy string, n int, used func() map[string]int) []string {
+		var picked []string
+		for i := 0; i < n; i++ {
+			picked = append(picked, pool.pick(lowerDevices, strategy, used))
+		}
+		return picked
+	}
+
+	Context("WHEN picking in turn", func() {
+		It("SHOULD pick every lower device in turn", func() {
+			Expect(pickN(LowerDeviceStrategyRoundRobin, 4, noneUsed)).To(Equal([]string{"eth0", "eth1", "eth2", "eth0"}))
+		})
+
+		It("SHOULD skip unhealthy lower devices", func() {
+			pool.setHealth("eth1", false)
+			Expect(pickN(LowerDeviceStrategyRoundRobin, 3, noneUsed)).To(Equal([]string{"eth0", "eth2", "eth0"}))
+		})
+
+		It("SHOULD be the default strategy", func() {
+			Expect(pickN("", 2, noneUsed)).To(Equal([]string{"eth0", "eth1"}))
+		})
+	})
+
+	Context("WHEN picking the first healthy", func() {
+		It("SHOULD fall back on the next lower device", func() {
+			Expect(pool.pick(lowerDevices, LowerDeviceStrategyFirstHealthy, noneUsed)).To(Equal("eth0"))
+			pool.setHealth("eth0", false)
+			Expect(pool.pick(lowerDevices, LowerDeviceStrategyFirstHealthy, noneUsed)).To(Equal("eth1"))
+			pool.setHealth("eth0", true)
+			Expect(pool.pick(lowerDevices, LowerDeviceStrategyFirstHealthy, noneUsed)).To(Equal("eth0"))
+		})
+
+		It("SHOULD pick among all lower devices when none is healthy", func() {
+			for _, lowerDevice := range lowerDevices {
+				pool.setHealth(lowerDevice, false)
+			}
+			Expect(pool.pick(lowerDevices, LowerDeviceStrategyFirstHealthy, noneUsed)).To(Equal("eth0"))
+		})
+	})
+
+	Context("WHEN picking the least used", func() {
+		It("SHOULD pick the healthy lower device with the fewest devices", func() {
+			used := func() map[string]int {
+				return map[string]int{"eth0": 3, "eth1": 1, "eth2": 2}
+			}
+			Expect(pool.pick(lowerDevices, LowerDeviceStrategyLeastUsed, used)).To(Equal("eth1"))
+			pool.setHealth("eth1", false)
+			Expect(pool.pick(lowerDevices, LowerDeviceStrategyLeastUsed, used)).To(Equal("eth2"))
+		})
+
+		It("SHOULD count the allocated devices from the published device info", func() {
+			dpDir, err := os.MkdirTemp("", "devinfo")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dpDir)
+			originalDPDir := devinfo.DPDir
+			devinfo.DPDir = dpDir
+			defer func() { devinfo.DPDir = originalDPDir }()
+
+			save := func(resource, deviceID, lowerDevice string) {
+				info := &devinfo.DeviceInfo{Tap: &devinfo.TapDevice{LowerDevice: lowerDevice}}
+				Expect(devinfo.SaveForDP(resourceNamespace+"/"+resource, deviceID, info)).To(Succeed())
+			}
+			save("dataplane", "dataplaneMvp0", "eth0")
+			save("dataplane", "dataplaneMvp1", "eth1")
+			save("dataplane", "dataplaneMvp2", "eth1")
+			save("dataplane-100", "dataplane-100Mvp0", "eth0.100")
+
+			Expect(usedLowerDevices(resourceNamespace + "/dataplane")).To(Equal(map[string]int{"eth0": 1, "eth1": 2}))
+		})
+	})
+
+	It("SHOULD report health changes only", func() {
+		changed, known := pool.setHealth("eth0", true)
+		Expect(changed).To(BeTrue())
+		Expect(known).To(BeFalse())
+		changed, known = pool.setHealth("eth0", true)
+		Expect(changed).To(BeFalse())
+		Expect(known).To(BeTrue())
+		changed, known = pool.setHealth("eth0", false)
+		Expect(changed).To(BeTrue())
+		Expect(known).To(BeTrue())
+	})
+
+	It("SHOULD back a resource with LowerDevice unless LowerDevices is set", func() {
+		Expect(Config{LowerDevice: "eth0"}.lowerDevices()).To(Equal([]string{"eth0"}))
+		Expect(Config{LowerDevice: "eth0", LowerDevices: []string{"eth1", "eth2"}}.lowerDevices()).To(Equal([]string{"eth1", "eth2"}))
+	})
+})
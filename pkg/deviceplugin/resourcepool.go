@@ -0,0 +1,355 @@
+package deviceplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+// resourcePoolResync is how often the MacvtapResourcePools and the node are
+// synced again regardless of changes.
+const resourcePoolResync = 10 * time.Minute
+
+// MacvtapResourcePoolResource is the API resource of the MacvtapResourcePools.
+var MacvtapResourcePoolResource = schema.GroupVersionResource{
+	Group:    util.ResourceNamespace,
+	Version:  "v1alpha1",
+	Resource: "macvtapresourcepools",
+}
+
+// MacvtapResourcePool configures a resource, named after the pool, on the
+// nodes it selects. Every node reports in the status how it offers the
+// resource.
+type MacvtapResourcePool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MacvtapResourcePoolSpec   `json:"spec"`
+	Status MacvtapResourcePoolStatus `json:"status,omitempty"`
+}
+
+// MacvtapResourcePoolSpec holds the configuration of the resource, as Config
+// does, and the nodes to offer it on.
+type MacvtapResourcePoolSpec struct {
+	// NodeSelector selects the nodes offering the resource, every node if
+	// unset.
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+
+	LowerDevice         string     `json:"lowerDevice,omitempty"`
+	LowerDevices        []string   `json:"lowerDevices,omitempty"`
+	LowerDeviceStrategy string     `json:"lowerDeviceStrategy,omitempty"`
+	Selectors           *Selectors `json:"selectors,omitempty"`
+	Type                string     `json:"type,omitempty"`
+	Mode                string     `json:"mode,omitempty"`
+	Capacity            int        `json:"capacity,omitempty"`
+	Queues              int        `json:"queues,omitempty"`
+	VLAN                *VlanRange `json:"vlan,omitempty"`
+	AllocationPolicy    string     `json:"allocationPolicy,omitempty"`
+}
+
+// MacvtapResourcePoolStatus holds the status of the resource on every node
+// offering it, by node name.
+type MacvtapResourcePoolStatus struct {
+	Nodes map[string]MacvtapResourcePoolNodeStatus `json:"nodes,omitempty"`
+}
+
+// MacvtapResourcePoolNodeStatus is the status of the resource on a node.
+type MacvtapResourcePoolNodeStatus struct {
+	// ObservedGeneration is the generation of the pool the status is about.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Resources are the names of the resources offered, one per VLAN.
+	Resources []string `json:"resources,omitempty"`
+	// LowerDevices are the links the devices are created on.
+	LowerDevices []string `json:"lowerDevices,omitempty"`
+	// Capacity is the number of devices of each resource.
+	Capacity int `json:"capacity,omitempty"`
+	// Error tells why the pool is not offered, or why a previous version of
+	// it still is.
+	Error string `json:"error,omitempty"`
+}
+
+// ResourcePoolSource is where the resourcePool lister reads the
+// MacvtapResourcePools from, and writes the status of its node to.
+type ResourcePoolSource struct {
+	Client     dynamic.Interface
+	KubeClient kubernetes.Interface
+	NodeName   string
+}
+
+// NewResourcePoolLister returns a lister offering the resources of the
+// MacvtapResourcePools that select the node.
+func NewResourcePoolLister(netNsPath string, source *ResourcePoolSource) *macvtapLister {
+	ml := NewMacvtapLister(netNsPath, ListerTypeResourcePool)
+	ml.PoolSource = source
+	return ml
+}
+
+func poolFromUnstructured(obj *unstructured.Unstructured) (*MacvtapResourcePool, error) {
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	pool := &MacvtapResourcePool{}
+	if err = json.Unmarshal(data, pool); err != nil {
+		return nil, fmt.Errorf("invalid MacvtapResourcePool %s: %v", obj.GetName(), err)
+	}
+	return pool, nil
+}
+
+// selects tells whether the pool selects a node of the given labels.
+func (p *MacvtapResourcePool) selects(nodeLabels labels.Set) (bool, error) {
+	if p.Spec.NodeSelector == nil {
+		return true, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(p.Spec.NodeSelector)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(nodeLabels), nil
+}
+
+// config returns the configuration of the resource of the pool.
+func (p *MacvtapResourcePool) config() Config {
+	return Config{
+		Name:                p.Name,
+		LowerDevice:         p.Spec.LowerDevice,
+		LowerDevices:        p.Spec.LowerDevices,
+		LowerDeviceStrategy: p.Spec.LowerDeviceStrategy,
+		Selectors:           p.Spec.Selectors,
+		Type:                p.Spec.Type,
+		Mode:                p.Spec.Mode,
+		Capacity:            p.Spec.Capacity,
+		Queues:              p.Spec.Queues,
+		VLAN:                p.Spec.VLAN,
+		AllocationPolicy:    p.Spec.AllocationPolicy,
+	}
+}
+
+// resourcePoolSync turns the MacvtapResourcePools into the configurations of
+// the node, and reports their status.
+type resourcePoolSync struct {
+	ml     *macvtapLister
+	source *ResourcePoolSource
+	pools  cache.GenericLister
+	nodes  corev1listers.NodeLister
+	// lastGood holds the last valid configuration of every pool, still
+	// offered while the pool is invalid.
+	lastGood map[string]Config
+}
+
+func (ml *macvtapLister) ResourcePoolDiscover(pluginListCh chan dpm.PluginNameList) {
+	source := ml.PoolSource
+	stop := make(chan struct{})
+	defer close(stop)
+
+	syncCh := make(chan struct{}, 1)
+	requestSync := func() {
+		select {
+		case syncCh <- struct{}{}:
+		default:
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { requestSync() },
+		UpdateFunc: func(interface{}, interface{}) { requestSync() },
+		DeleteFunc: func(interface{}) { requestSync() },
+	}
+
+	poolFactory := dynamicinformer.NewDynamicSharedInformerFactory(source.Client, resourcePoolResync)
+	pools := poolFactory.ForResource(MacvtapResourcePoolResource)
+	pools.Informer().AddEventHandler(handler)
+	nodeFactory := nodeInformerFactory(source.KubeClient, source.NodeName, resourcePoolResync)
+	nodes := nodeFactory.Core().V1().Nodes()
+	nodes.Informer().AddEventHandler(handler)
+	poolFactory.Start(stop)
+	nodeFactory.Start(stop)
+	if !cache.WaitForCacheSync(stop, pools.Informer().HasSynced, nodes.Informer().HasSynced) {
+		glog.Error("MacvtapResourcePool informers failed to sync")
+		return
+	}
+
+	// Resources with selectors are re-evaluated on link events, as links
+	// they select may appear, disappear or change.
+	go util.OnSuitableMacvtapParentEvent(
+		ml.NetNsPath,
+		requestSync,
+		stop,
+		func(err error) {
+			glog.Error(err)
+		})
+
+	poolSync := &resourcePoolSync{
+		ml:       ml,
+		source:   source,
+		pools:    pools.Lister(),
+		nodes:    nodes.Lister(),
+		lastGood: make(map[string]Config),
+	}
+	first := true
+	requestSync()
+	for {
+		select {
+		case <-syncCh:
+			plugins, changed := poolSync.sync()
+			if first || changed {
+				ml.publish(pluginListCh, plugins)
+			}
+			first = false
+		case _, open := <-pluginListCh:
+			if !open {
+				return
+			}
+		}
+	}
+}
+
+// sync applies the configurations of the pools selecting the node, and
+// returns the names of the resources and whether any changed.
+func (s *resourcePoolSync) sync() (dpm.PluginNameList, bool) {
+	nodeLabels := labels.Set{}
+	if node, err := s.nodes.Get(s.source.NodeName); err != nil {
+		glog.Errorf("Error getting node %s: %v", s.source.NodeName, err)
+	} else {
+		nodeLabels = node.Labels
+	}
+
+	objs, err := s.pools.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("Error listing MacvtapResourcePools: %v", err)
+	}
+
+	configs := make(map[string]Config)
+	seen := make(map[string]bool, len(objs))
+	for _, obj := range objs {
+		pool, err := poolFromUnstructured(obj.(*unstructured.Unstructured))
+		if err != nil {
+			glog.Error(err)
+			continue
+		}
+		seen[pool.Name] = true
+
+		status := &MacvtapResourcePoolNodeStatus{ObservedGeneration: pool.Generation}
+		selected, err := pool.selects(nodeLabels)
+		if err != nil {
+			glog.Errorf("Invalid node selector of MacvtapResourcePool %s: %v", pool.Name, err)
+			status.Error = fmt.Sprintf("invalid nodeSelector: %v", err)
+			s.reportStatus(pool, status)
+			continue
+		}
+		if !selected {
+			delete(s.lastGood, pool.Name)
+			s.reportStatus(pool, nil)
+			continue
+		}
+
+		for name, cfg := range s.resolve(pool, status) {
+			configs[name] = cfg
+		}
+		s.reportStatus(pool, status)
+	}
+	for name := range s.lastGood {
+		if !seen[name] {
+			delete(s.lastGood, name)
+		}
+	}
+
+	s.ml.Lock()
+	defer s.ml.Unlock()
+	plugins, changed, err := s.ml.applyConfigs(configs)
+	if err != nil {
+		glog.Errorf("Error applying MacvtapResourcePools: %v", err)
+	}
+	return plugins, changed
+}
+
+// resolve returns the configurations of the resources of the pool on the
+// node, and fills the status accordingly.
+func (s *resourcePoolSync) resolve(pool *MacvtapResourcePool, status *MacvtapResourcePoolNodeStatus) map[string]Config {
+	cfg := pool.config()
+	if err := errors.Join(validateConfig(cfg)...); err != nil {
+		glog.Errorf("Invalid MacvtapResourcePool %s: %v", pool.Name, err)
+		status.Error = err.Error()
+		good, ok := s.lastGood[pool.Name]
+		if !ok {
+			return nil
+		}
+		cfg = good
+	} else {
+		s.lastGood[pool.Name] = cfg
+	}
+
+	resolved, err := s.ml.resolveConfigs(map[string]Config{cfg.Name: cfg})
+	if err != nil {
+		glog.Errorf("Error resolving MacvtapResourcePool %s: %v", pool.Name, err)
+		status.Error = err.Error()
+		return nil
+	}
+	if len(resolved) == 0 {
+		status.Error = "no lower device selected"
+		return nil
+	}
+
+	lowerDevices := make(map[string]bool)
+	for name, resolvedCfg := range resolved {
+		status.Resources = append(status.Resources, name)
+		status.Capacity = resolvedCfg.capacity()
+		parents := resolvedCfg.vlanParents
+		if len(parents) == 0 {
+			parents = resolvedCfg.lowerDevices()
+		}
+		for _, lowerDevice := range parents {
+			lowerDevices[lowerDevice] = true
+		}
+	}
+	for lowerDevice := range lowerDevices {
+		status.LowerDevices = append(status.LowerDevices, lowerDevice)
+	}
+	sort.Strings(status.Resources)
+	sort.Strings(status.LowerDevices)
+	return resolved
+}
+
+// reportStatus sets the status of the node in the pool, or removes it if nil.
+// Each node only patches its own entry, so that nodes do not conflict.
+func (s *resourcePoolSync) reportStatus(pool *MacvtapResourcePool, status *MacvtapResourcePoolNodeStatus) {
+	current, found := pool.Status.Nodes[s.source.NodeName]
+	if status == nil && !found || status != nil && found && reflect.DeepEqual(current, *status) {
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"nodes": map[string]interface{}{
+				s.source.NodeName: status,
+			},
+		},
+	})
+	if err != nil {
+		glog.Errorf("Error reporting status of MacvtapResourcePool %s: %v", pool.Name, err)
+		return
+	}
+	_, err = s.source.Client.Resource(MacvtapResourcePoolResource).Patch(
+		context.Background(), pool.Name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	if err != nil {
+		glog.Errorf("Error reporting status of MacvtapResourcePool %s: %v", pool.Name, err)
+	}
+}
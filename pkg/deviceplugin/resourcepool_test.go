@@ -0,0 +1,144 @@
+package deviceplugin
+
+import (
+	"context"
+
+	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MacvtapResourcePool lister", func() {
+	const nodeName = "node01"
+
+	var (
+		client       *dynamicfake.FakeDynamicClient
+		lister       *macvtapLister
+		pluginListCh chan dpm.PluginNameList
+	)
+
+	pool := func(name string, spec map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": MacvtapResourcePoolResource.GroupVersion().String(),
+			"kind":       "MacvtapResourcePool",
+			"metadata":   map[string]interface{}{"name": name, "generation": int64(1)},
+			"spec":       spec,
+		}}
+	}
+
+	nodeStatus := func(name string) func() map[string]interface{} {
+		return func() map[string]interface{} {
+			obj, err := client.Resource(MacvtapResourcePoolResource).Get(context.Background(), name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			status, _, _ := unstructured.NestedMap(obj.Object, "status", "nodes", nodeName)
+			return status
+		}
+	}
+
+	start := func(pools ...runtime.Object) {
+		client = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{MacvtapResourcePoolResource: "MacvtapResourcePoolList"},
+			pools...)
+		kubeClient := fake.NewSimpleClientset(&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: nodeName, Labels: map[string]string{"nic": "fast"}},
+		})
+		lister = NewResourcePoolLister("/proc/self/ns/net", &ResourcePoolSource{
+			Client:     client,
+			KubeClient: kubeClient,
+			NodeName:   nodeName,
+		})
+		pluginListCh = make(chan dpm.PluginNameList)
+		go lister.Discover(pluginListCh)
+	}
+
+	AfterEach(func() {
+		close(pluginListCh)
+	})
+
+	It("SHOULD offer the pools selecting the node and report their status", func() {
+		start(
+			pool("dataplane", map[string]interface{}{
+				"nodeSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"nic": "fast"}},
+				"lowerDevice":  "eth0",
+				"capacity":     int64(20),
+			}),
+			pool("storage", map[string]interface{}{
+				"nodeSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"nic": "slow"}},
+				"lowerDevice":  "eth1",
+			}),
+		)
+
+		Eventually(pluginListCh).Should(Receive(ConsistOf("dataplane")))
+		plugin := lister.NewPlugin("dataplane").(*macvtapDevicePlugin)
+		Expect(plugin.LowerDevice).To(Equal("eth0"))
+		Expect(plugin.Capacity).To(Equal(20))
+
+		Eventually(nodeStatus("dataplane")).Should(Equal(map[string]interface{}{
+			"observedGeneration": int64(1),
+			"resources":          []interface{}{"dataplane"},
+			"lowerDevices":       []interface{}{"eth0"},
+			"capacity":           int64(20),
+		}))
+		Consistently(nodeStatus("storage")).Should(BeNil())
+	})
+
+	It("SHOULD report the capacity the resources offer", func() {
+		start(pool("dataplane", map[string]interface{}{
+			"lowerDevices": []interface{}{"eth0", "eth1"},
+			"mode":         "passthru",
+		}))
+		Eventually(pluginListCh).Should(Receive(ConsistOf("dataplane")))
+
+		Eventually(nodeStatus("dataplane")).Should(HaveKeyWithValue("capacity", int64(2)))
+	})
+
+	It("SHOULD follow the changes of the pools", func() {
+		start(pool("dataplane", map[string]interface{}{"lowerDevice": "eth0"}))
+		Eventually(pluginListCh).Should(Receive(ConsistOf("dataplane")))
+
+		_, err := client.Resource(MacvtapResourcePoolResource).Create(context.Background(),
+			pool("storage", map[string]interface{}{"lowerDevice": "eth1"}), metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(pluginListCh).Should(Receive(ConsistOf("dataplane", "storage")))
+
+		err = client.Resource(MacvtapResourcePoolResource).Delete(context.Background(), "dataplane", metav1.DeleteOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(pluginListCh).Should(Receive(ConsistOf("storage")))
+	})
+
+	It("SHOULD report an invalid pool and keep offering its previous version", func() {
+		start(pool("dataplane", map[string]interface{}{"lowerDevice": "eth0"}))
+		Eventually(pluginListCh).Should(Receive(ConsistOf("dataplane")))
+
+		invalid := pool("dataplane", map[string]interface{}{"lowerDevice": "eth0", "mode": "bogus"})
+		invalid.SetGeneration(2)
+		_, err := client.Resource(MacvtapResourcePoolResource).Update(context.Background(), invalid, metav1.UpdateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(nodeStatus("dataplane")).Should(And(
+			HaveKeyWithValue("observedGeneration", int64(2)),
+			HaveKeyWithValue("error", ContainSubstring(`unknown macvtap mode: "bogus"`)),
+			HaveKeyWithValue("lowerDevices", []interface{}{"eth0"}),
+		))
+		Consistently(pluginListCh).ShouldNot(Receive())
+		Expect(lister.NewPlugin("dataplane").(*macvtapDevicePlugin).Mode).To(BeEmpty())
+	})
+
+	It("SHOULD not offer an invalid pool", func() {
+		start(
+			pool("dataplane", map[string]interface{}{"lowerDevice": "eth0"}),
+			pool("storage", map[string]interface{}{}),
+		)
+		Eventually(pluginListCh).Should(Receive(ConsistOf("dataplane")))
+		Eventually(nodeStatus("storage")).Should(HaveKeyWithValue("error",
+			"one of lowerDevice, lowerDevices or selectors is required"))
+	})
+})
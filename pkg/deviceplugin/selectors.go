@@ -0,0 +1,199 @@
+package deviceplugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/golang/glog"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+// Selectors select the lower devices of a resource by their properties
+// rather than by name, so that the same configuration suits nodes whose NICs
+// are named differently. A link is selected if it matches every selector that
+// is set, and it matches a selector if it matches any of its values.
+type Selectors struct {
+	// IfNames are regular expressions matched against the whole link name.
+	IfNames []string `json:"ifNames,omitempty"`
+	// Drivers are kernel driver names, such as i40e or mlx5_core.
+	Drivers []string `json:"drivers,omitempty"`
+	// Vendors and Devices are hexadecimal PCI vendor and device IDs, such as
+	// 8086 and 1572.
+	Vendors []string `json:"vendors,omitempty"`
+	Devices []string `json:"devices,omitempty"`
+	// PCIAddresses are PCI addresses, such as 0000:3b:00.0.
+	PCIAddresses []string `json:"pciAddresses,omitempty"`
+	// PermanentMACs are permanent MAC addresses.
+	PermanentMACs []string `json:"permanentMacs,omitempty"`
+	// Speeds are link speeds in Mb/s, such as 25000. Links without carrier
+	// report no speed and are not excluded by this selector.
+	Speeds []int `json:"speeds,omitempty"`
+	// LinkTypes are netlink link types: device, bond or vlan.
+	LinkTypes []string `json:"linkTypes,omitempty"`
+}
+
+// linkProperties are the properties of a link that selectors match.
+type linkProperties struct {
+	Name         string
+	Driver       string
+	Vendor       string
+	Device       string
+	PCIAddress   string
+	PermanentMAC string
+	Speed        int
+	LinkType     string
+}
+
+// validate checks that the selectors are well formed.
+func (s *Selectors) validate() error {
+	for _, ifName := range s.IfNames {
+		if _, err := regexp.Compile(ifName); err != nil {
+			return fmt.Errorf("invalid ifNames selector %q: %v", ifName, err)
+		}
+	}
+	return nil
+}
+
+// match tells whether a link matches the selectors.
+func (s *Selectors) match(link linkProperties) bool {
+	matchAny := func(values []string, value string, equal func(a, b string) bool) bool {
+		if len(values) == 0 {
+			return true
+		}
+		for _, v := range values {
+			if equal(v, value) {
+				return true
+			}
+		}
+		return false
+	}
+	sameHex := func(a, b string) bool {
+		return strings.EqualFold(strings.TrimPrefix(a, "0x"), strings.TrimPrefix(b, "0x"))
+	}
+	matchName := func(expr, name string) bool {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		return err == nil && re.MatchString(name)
+	}
+
+	// A link without carrier has no speed. Rather than dropping it from the
+	// resource until it is up again, it is not excluded on its speed.
+	var speeds []string
+	if link.Speed >= 0 {
+		for _, speed := range s.Speeds {
+			speeds = append(speeds, strconv.Itoa(speed))
+		}
+	}
+
+	return matchAny(speeds, strconv.Itoa(link.Speed), strings.EqualFold) &&
+		matchAny(s.IfNames, link.Name, matchName) &&
+		matchAny(s.Drivers, link.Driver, strings.EqualFold) &&
+		matchAny(s.Vendors, link.Vendor, sameHex) &&
+		matchAny(s.Devices, link.Device, sameHex) &&
+		matchAny(s.PCIAddresses, link.PCIAddress, strings.EqualFold) &&
+		matchAny(s.PermanentMACs, link.PermanentMAC, strings.EqualFold) &&
+		matchAny(s.LinkTypes, link.LinkType, strings.EqualFold)
+}
+
+// readLinkProperties completes the properties of a parent link with those the
+// kernel exposes in sysfs. Links not backed by a device, such as bonds, have
+// no driver or PCI properties.
+func readLinkProperties(parent util.ParentLink) linkProperties {
+	link := linkProperties{
+		Name:         parent.Name,
+		PermanentMAC: parent.PermanentMAC,
+		LinkType:     parent.Type,
+		Speed:        -1,
+	}
+
+	deviceDir := filepath.Join(sysClassNet, parent.Name, "device")
+	if driver, err := filepath.EvalSymlinks(filepath.Join(deviceDir, "driver")); err == nil {
+		link.Driver = filepath.Base(driver)
+	}
+	if device, err := filepath.EvalSymlinks(deviceDir); err == nil {
+		link.PCIAddress = filepath.Base(device)
+	}
+	link.Vendor = readSysfsString(filepath.Join(deviceDir, "vendor"))
+	link.Device = readSysfsString(filepath.Join(deviceDir, "device"))
+	if speed, err := strconv.Atoi(readSysfsString(filepath.Join(sysClassNet, parent.Name, "speed"))); err == nil {
+		link.Speed = speed
+	}
+	return link
+}
+
+func readSysfsString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// selectLowerDevices returns the names of the links of the namespace that
+// match the selectors, sorted.
+func selectLowerDevices(selectors *Selectors, netNsPath string) ([]string, error) {
+	var parents []util.ParentLink
+	err := ns.WithNetNSPath(netNsPath, func(_ ns.NetNS) error {
+		var err error
+		parents, err = util.ListSuitableMacvtapParents()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []string
+	for _, parent := range parents {
+		if selectors.match(readLinkProperties(parent)) {
+			selected = append(selected, parent.Name)
+		}
+	}
+	sort.Strings(selected)
+	return selected, nil
+}
+
+// resolveSelectors sets the lower devices of the configurations with selectors
+// to the links of the namespace they select. Configurations that select no
+// link are left out, as the node does not have the NICs they ask for.
+func resolveSelectors(configs map[string]Config, netNsPath string) (map[string]Config, error) {
+	resolved := make(map[string]Config, len(configs))
+	for name, cfg := range configs {
+		if cfg.Selectors == nil {
+			resolved[name] = cfg
+			continue
+		}
+		if err := cfg.Selectors.validate(); err != nil {
+			glog.Errorf("Ignoring resource %s: %v", name, err)
+			continue
+		}
+		lowerDevices, err := selectLowerDevices(cfg.Selectors, netNsPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(lowerDevices) == 0 {
+			glog.V(3).Infof("Resource %s selects no link", name)
+			continue
+		}
+		glog.V(3).Infof("Resource %s selects %v", name, lowerDevices)
+		cfg.LowerDevice = ""
+		cfg.LowerDevices = lowerDevices
+		resolved[name] = cfg
+	}
+	return resolved, nil
+}
+
+// hasSelectors tells whether any of the configurations has selectors.
+func hasSelectors(configs map[string]Config) bool {
+	for _, cfg := range configs {
+		if cfg.Selectors != nil {
+			return true
+		}
+	}
+	return false
+}
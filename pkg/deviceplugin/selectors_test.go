@@ -0,0 +1,122 @@
+package deviceplugin
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Selectors", func() {
+	nic := linkProperties{
+		Name:         "ens1f0",
+		Driver:       "i40e",
+		Vendor:       "0x8086",
+		Device:       "0x1572",
+		PCIAddress:   "0000:3b:00.0",
+		PermanentMAC: "3c:fd:fe:00:00:01",
+		Speed:        25000,
+		LinkType:     "device",
+	}
+
+	Context("WHEN matching a link", func() {
+		It("SHOULD match with no selector set", func() {
+			Expect((&Selectors{}).match(nic)).To(BeTrue())
+		})
+
+		It("SHOULD match when every selector set matches", func() {
+			selectors := &Selectors{
+				IfNames:       []string{"ens.*"},
+				Drivers:       []string{"ice", "i40e"},
+				Vendors:       []string{"8086"},
+				Devices:       []string{"1572"},
+				PCIAddresses:  []string{"0000:3b:00.0"},
+				PermanentMACs: []string{"3C:FD:FE:00:00:01"},
+				Speeds:        []int{10000, 25000},
+				LinkTypes:     []string{"device"},
+			}
+			Expect(selectors.match(nic)).To(BeTrue())
+		})
+
+		It("SHOULD not match when any selector set does not match", func() {
+			Expect((&Selectors{IfNames: []string{"eth.*"}}).match(nic)).To(BeFalse())
+			Expect((&Selectors{Drivers: []string{"mlx5_core"}}).match(nic)).To(BeFalse())
+			Expect((&Selectors{Vendors: []string{"15b3"}}).match(nic)).To(BeFalse())
+			Expect((&Selectors{Devices: []string{"1017"}}).match(nic)).To(BeFalse())
+			Expect((&Selectors{PCIAddresses: []string{"0000:3b:00.1"}}).match(nic)).To(BeFalse())
+			Expect((&Selectors{PermanentMACs: []string{"3c:fd:fe:00:00:02"}}).match(nic)).To(BeFalse())
+			Expect((&Selectors{Speeds: []int{100000}}).match(nic)).To(BeFalse())
+			Expect((&Selectors{LinkTypes: []string{"bond"}}).match(nic)).To(BeFalse())
+			Expect((&Selectors{Drivers: []string{"i40e"}, LinkTypes: []string{"bond"}}).match(nic)).To(BeFalse())
+		})
+
+		It("SHOULD match the whole interface name", func() {
+			Expect((&Selectors{IfNames: []string{"ens1"}}).match(nic)).To(BeFalse())
+			Expect((&Selectors{IfNames: []string{"ens1f0|ens1f1"}}).match(nic)).To(BeTrue())
+		})
+
+		It("SHOULD not exclude a link without carrier on its speed", func() {
+			down := nic
+			down.Speed = -1
+			Expect((&Selectors{Speeds: []int{100000}}).match(down)).To(BeTrue())
+		})
+	})
+
+	It("SHOULD reject an invalid interface name expression", func() {
+		Expect((&Selectors{IfNames: []string{"ens("}}).validate()).NotTo(Succeed())
+	})
+
+	It("SHOULD be read from the configuration", func() {
+		var cfg Config
+		err := json.Unmarshal([]byte(`{"name":"dataplane","selectors":{"drivers":["i40e"],"speeds":[25000]}}`), &cfg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Selectors).To(Equal(&Selectors{Drivers: []string{"i40e"}, Speeds: []int{25000}}))
+	})
+
+	Context("WHEN reading the properties of a link", func() {
+		var originalSysClassNet string
+
+		BeforeEach(func() {
+			dir, err := os.MkdirTemp("", "sysclassnet")
+			Expect(err).NotTo(HaveOccurred())
+			originalSysClassNet = sysClassNet
+			sysClassNet = dir
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(sysClassNet)
+			sysClassNet = originalSysClassNet
+		})
+
+		It("SHOULD read them from sysfs", func() {
+			pciDevice := filepath.Join(sysClassNet, "devices", "0000:3b:00.0")
+			driver := filepath.Join(sysClassNet, "drivers", "i40e")
+			Expect(os.MkdirAll(pciDevice, 0755)).To(Succeed())
+			Expect(os.MkdirAll(driver, 0755)).To(Succeed())
+			Expect(os.Symlink(driver, filepath.Join(pciDevice, "driver"))).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(pciDevice, "vendor"), []byte("0x8086\n"), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(pciDevice, "device"), []byte("0x1572\n"), 0644)).To(Succeed())
+
+			linkDir := filepath.Join(sysClassNet, "ens1f0")
+			Expect(os.MkdirAll(linkDir, 0755)).To(Succeed())
+			Expect(os.Symlink(pciDevice, filepath.Join(linkDir, "device"))).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(linkDir, "speed"), []byte("25000\n"), 0644)).To(Succeed())
+
+			parent := util.ParentLink{Name: "ens1f0", Type: "device", PermanentMAC: "3c:fd:fe:00:00:01"}
+			Expect(readLinkProperties(parent)).To(Equal(nic))
+		})
+
+		It("SHOULD leave out the device properties of a virtual link", func() {
+			Expect(os.MkdirAll(filepath.Join(sysClassNet, "bond0"), 0755)).To(Succeed())
+			Expect(readLinkProperties(util.ParentLink{Name: "bond0", Type: "bond"})).To(Equal(linkProperties{
+				Name:     "bond0",
+				LinkType: "bond",
+				Speed:    -1,
+			}))
+		})
+	})
+})
@@ -0,0 +1,102 @@
+package deviceplugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// sysClassNet is where the kernel exposes the network interfaces of the node.
+var sysClassNet = "/sys/class/net"
+
+// numaNodes returns the NUMA nodes of the NICs backing a link. Links that are
+// not backed by a device, such as bonds or VLAN sub-interfaces, are followed
+// down to their lower links. It returns nil if the NUMA node is unknown.
+func numaNodes(link string) []int {
+	nodes := map[int]struct{}{}
+	collectNumaNodes(link, nodes, map[string]bool{})
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	var sorted []int
+	for node := range nodes {
+		sorted = append(sorted, node)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+func collectNumaNodes(link string, nodes map[int]struct{}, visited map[string]bool) {
+	if visited[link] {
+		return
+	}
+	visited[link] = true
+
+	data, err := os.ReadFile(filepath.Join(sysClassNet, link, "device", "numa_node"))
+	if err == nil {
+		// The kernel reports -1 when the platform has no NUMA information
+		if node, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && node >= 0 {
+			nodes[node] = struct{}{}
+		}
+		return
+	}
+
+	// Bond slaves and the real device of a VLAN sub-interface are listed as
+	// lower_<name> links
+	lowers, _ := filepath.Glob(filepath.Join(sysClassNet, link, "lower_*"))
+	for _, lower := range lowers {
+		collectNumaNodes(strings.TrimPrefix(filepath.Base(lower), "lower_"), nodes, visited)
+	}
+}
+
+// topologyInfo returns the topology of the devices on top of the lower
+// devices, or nil if unknown.
+func topologyInfo(lowerDevices ...string) *pluginapi.TopologyInfo {
+	nodes := map[int]struct{}{}
+	for _, lowerDevice := range lowerDevices {
+		for _, node := range numaNodes(lowerDevice) {
+			nodes[node] = struct{}{}
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	var sorted []int
+	for node := range nodes {
+		sorted = append(sorted, node)
+	}
+	sort.Ints(sorted)
+	topology := &pluginapi.TopologyInfo{}
+	for _, node := range sorted {
+		topology.Nodes = append(topology.Nodes, &pluginapi.NUMANode{ID: int64(node)})
+	}
+	return topology
+}
+
+// numaGroups maps each lower device to the lower devices on the same NUMA
+// nodes, in the given order. Lower devices of unknown NUMA node are grouped
+// together.
+func numaGroups(lowerDevices []string) map[string][]string {
+	nodesOf := make(map[string]string, len(lowerDevices))
+	byNodes := make(map[string][]string)
+	for _, lowerDevice := range lowerDevices {
+		if _, ok := nodesOf[lowerDevice]; ok {
+			continue
+		}
+		nodes := fmt.Sprint(numaNodes(lowerDevice))
+		nodesOf[lowerDevice] = nodes
+		byNodes[nodes] = append(byNodes[nodes], lowerDevice)
+	}
+	groups := make(map[string][]string, len(lowerDevices))
+	for lowerDevice, nodes := range nodesOf {
+		groups[lowerDevice] = byNodes[nodes]
+	}
+	return groups
+}
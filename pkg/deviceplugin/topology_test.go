@@ -0,0 +1,135 @@
+package deviceplugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Topology", func() {
+	var originalSysClassNet string
+
+	addNic := func(name, numaNode string) {
+		deviceDir := filepath.Join(sysClassNet, name, "device")
+		Expect(os.MkdirAll(deviceDir, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(deviceDir, "numa_node"), []byte(numaNode+"\n"), 0644)).To(Succeed())
+	}
+
+	addUpper := func(name string, lowers ...string) {
+		Expect(os.MkdirAll(filepath.Join(sysClassNet, name), 0755)).To(Succeed())
+		for _, lower := range lowers {
+			Expect(os.Symlink(filepath.Join("..", lower), filepath.Join(sysClassNet, name, "lower_"+lower))).To(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		dir, err := os.MkdirTemp("", "sysclassnet")
+		Expect(err).NotTo(HaveOccurred())
+		originalSysClassNet = sysClassNet
+		sysClassNet = dir
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(sysClassNet)
+		sysClassNet = originalSysClassNet
+	})
+
+	It("SHOULD report the NUMA node of a NIC", func() {
+		addNic("eth0", "1")
+		Expect(topologyInfo("eth0")).To(Equal(&pluginapi.TopologyInfo{
+			Nodes: []*pluginapi.NUMANode{{ID: 1}},
+		}))
+	})
+
+	It("SHOULD report no topology when the NUMA node is unknown", func() {
+		addNic("eth0", "-1")
+		Expect(topologyInfo("eth0")).To(BeNil())
+	})
+
+	It("SHOULD report no topology for a missing link", func() {
+		Expect(topologyInfo("eth0")).To(BeNil())
+	})
+
+	It("SHOULD follow the real device of a VLAN sub-interface", func() {
+		addNic("eth0", "1")
+		addUpper("eth0.100", "eth0")
+		Expect(numaNodes("eth0.100")).To(Equal([]int{1}))
+	})
+
+	It("SHOULD report the NUMA nodes of all the slaves of a bond", func() {
+		addNic("eth0", "1")
+		addNic("eth1", "0")
+		addNic("eth2", "1")
+		addUpper("bond0", "eth0", "eth1", "eth2")
+		Expect(numaNodes("bond0")).To(Equal([]int{0, 1}))
+	})
+
+	It("SHOULD report the NUMA nodes of all the lower devices", func() {
+		addNic("eth0", "0")
+		addNic("eth1", "1")
+		Expect(topologyInfo("eth0", "eth1")).To(Equal(&pluginapi.TopologyInfo{
+			Nodes: []*pluginapi.NUMANode{{ID: 0}, {ID: 1}},
+		}))
+	})
+
+	It("SHOULD follow a VLAN sub-interface of a bond", func() {
+		addNic("eth0", "0")
+		addUpper("bond0", "eth0")
+		addUpper("bond0.100", "bond0")
+		Expect(numaNodes("bond0.100")).To(Equal([]int{0}))
+	})
+
+	Context("WHEN the lower devices of a resource are on several NUMA nodes", func() {
+		var mdp *macvtapDevicePlugin
+
+		BeforeEach(func() {
+			addNic("eth0", "0")
+			addNic("eth1", "1")
+			addNic("eth2", "0")
+			mdp = NewMacvtapDevicePlugin(&macvtapConfig{
+				Config: Config{Name: "dataplane", LowerDevices: []string{"eth0", "eth1", "eth2"}, Capacity: 6},
+			}, "")
+		})
+
+		It("SHOULD group the lower devices by NUMA node", func() {
+			Expect(numaGroups([]string{"eth0", "eth1", "eth2", "eth3"})).To(Equal(map[string][]string{
+				"eth0": {"eth0", "eth2"},
+				"eth1": {"eth1"},
+				"eth2": {"eth0", "eth2"},
+				"eth3": {"eth3"},
+			}))
+		})
+
+		It("SHOULD report the NUMA node and health of the lower devices of each device", func() {
+			devices := mdp.generateMacvtapDevices(mdp.lowerDevices(), map[string]bool{"eth0": true, "eth1": false, "eth2": false})
+			Expect(devices).To(HaveLen(6))
+			numa0 := &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: 0}}}
+			numa1 := &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: 1}}}
+			for i, device := range devices {
+				if i%3 == 1 {
+					Expect(device.Topology).To(Equal(numa1), device.ID)
+					Expect(device.Health).To(Equal(pluginapi.Unhealthy), device.ID)
+				} else {
+					Expect(device.Topology).To(Equal(numa0), device.ID)
+					Expect(device.Health).To(Equal(pluginapi.Healthy), device.ID)
+				}
+			}
+		})
+
+		It("SHOULD create each device on a lower device of its NUMA node", func() {
+			for i := 0; i < 12; i++ {
+				lowerDevice := mdp.pickLowerDevice(fmt.Sprint("dataplaneMvp", i%6), nil)
+				if i%3 == 1 {
+					Expect(lowerDevice).To(Equal("eth1"))
+				} else {
+					Expect(lowerDevice).To(BeElementOf("eth0", "eth2"))
+				}
+			}
+		})
+	})
+})
@@ -0,0 +1,147 @@
+package deviceplugin
+
+import (
+	"path/filepath"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/kubevirt/macvtap-cni/pkg/devinfo"
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+// HostRoot is the root of the host filesystem as seen by the device plugin,
+// which shares the PID namespace of the host. The netns of the pods, as
+// recorded by the CNI plugin, are opened under it.
+var HostRoot = "/proc/1/root"
+
+// podTrafficLabels are the labels of the traffic metrics of the pods.
+var podTrafficLabels = []string{"resource", "lower_device", "namespace", "pod"}
+
+// podTrafficCounter is a traffic metric of the pods, read from the statistics
+// of their links.
+type podTrafficCounter struct {
+	desc  *prometheus.Desc
+	value func(stats *netlink.LinkStatistics) uint64
+}
+
+func newPodTrafficCounter(name, help string, value func(stats *netlink.LinkStatistics) uint64) podTrafficCounter {
+	return podTrafficCounter{
+		desc:  prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "pod", name), help, podTrafficLabels, nil),
+		value: value,
+	}
+}
+
+var podTrafficCounters = []podTrafficCounter{
+	newPodTrafficCounter("receive_bytes_total", "Number of bytes received by the links allocated to the pod.",
+		func(s *netlink.LinkStatistics) uint64 { return s.RxBytes }),
+	newPodTrafficCounter("transmit_bytes_total", "Number of bytes transmitted by the links allocated to the pod.",
+		func(s *netlink.LinkStatistics) uint64 { return s.TxBytes }),
+	newPodTrafficCounter("receive_packets_total", "Number of packets received by the links allocated to the pod.",
+		func(s *netlink.LinkStatistics) uint64 { return s.RxPackets }),
+	newPodTrafficCounter("transmit_packets_total", "Number of packets transmitted by the links allocated to the pod.",
+		func(s *netlink.LinkStatistics) uint64 { return s.TxPackets }),
+	newPodTrafficCounter("receive_errors_total", "Number of receive errors of the links allocated to the pod.",
+		func(s *netlink.LinkStatistics) uint64 { return s.RxErrors }),
+	newPodTrafficCounter("transmit_errors_total", "Number of transmit errors of the links allocated to the pod.",
+		func(s *netlink.LinkStatistics) uint64 { return s.TxErrors }),
+	newPodTrafficCounter("receive_drops_total", "Number of received packets dropped by the links allocated to the pod.",
+		func(s *netlink.LinkStatistics) uint64 { return s.RxDropped }),
+	newPodTrafficCounter("transmit_drops_total", "Number of transmitted packets dropped by the links allocated to the pod.",
+		func(s *netlink.LinkStatistics) uint64 { return s.TxDropped }),
+}
+
+// podTrafficKey are the label values of the traffic metrics of a pod. The
+// statistics of the links a pod has of the same resource and lower device
+// add up.
+type podTrafficKey struct {
+	resource, lowerDevice, namespace, pod string
+}
+
+// PodTrafficCollector exports the traffic statistics of the links allocated
+// to pods. On every collection, the devices allocated to pods are listed from
+// the kubelet PodResources API and the statistics of each are read in the
+// netns of its pod, recorded by the CNI plugin along the device information.
+type PodTrafficCollector struct {
+	// Socket is the kubelet PodResources API socket.
+	Socket string
+
+	readStats func(netns, ifName string) (*netlink.LinkStatistics, error)
+}
+
+func NewPodTrafficCollector(socket string) *PodTrafficCollector {
+	return &PodTrafficCollector{
+		Socket: socket,
+		readStats: func(netns, ifName string) (*netlink.LinkStatistics, error) {
+			var stats *netlink.LinkStatistics
+			err := ns.WithNetNSPath(filepath.Join(HostRoot, netns), func(_ ns.NetNS) error {
+				var err error
+				stats, err = util.LinkStatistics(ifName)
+				return err
+			})
+			return stats, err
+		},
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *PodTrafficCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, counter := range podTrafficCounters {
+		ch <- counter.desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *PodTrafficCollector) Collect(ch chan<- prometheus.Metric) {
+	// The last known owners do, should the kubelet not answer
+	devices, err := listContainerDevices(c.Socket)
+	if err != nil {
+		glog.Warningf("Failed to list the allocated devices, using the last known ones: %v", err)
+	} else {
+		owners.update(devices)
+	}
+
+	traffic := make(map[podTrafficKey]*netlink.LinkStatistics)
+	for resourceName, devices := range owners.all() {
+		for id, owner := range devices {
+			info, err := devinfo.LoadForDP(resourceName, id)
+			if err != nil {
+				glog.Warningf("Failed to read the device info of %s: %v", id, err)
+				continue
+			}
+			// Devices not handed over to their pod yet have no traffic
+			if info == nil || info.Tap == nil || info.Tap.NetNS == "" || info.Tap.IfName == "" {
+				continue
+			}
+			stats, err := c.readStats(info.Tap.NetNS, info.Tap.IfName)
+			if err != nil {
+				glog.V(3).Infof("Failed to read the statistics of %s in pod %s/%s: %v", id, owner.Namespace, owner.Pod, err)
+				continue
+			}
+
+			key := podTrafficKey{resourceName, info.Tap.LowerDevice, owner.Namespace, owner.Pod}
+			total, ok := traffic[key]
+			if !ok {
+				total = &netlink.LinkStatistics{}
+				traffic[key] = total
+			}
+			total.RxBytes += stats.RxBytes
+			total.TxBytes += stats.TxBytes
+			total.RxPackets += stats.RxPackets
+			total.TxPackets += stats.TxPackets
+			total.RxErrors += stats.RxErrors
+			total.TxErrors += stats.TxErrors
+			total.RxDropped += stats.RxDropped
+			total.TxDropped += stats.TxDropped
+		}
+	}
+
+	for key, stats := range traffic {
+		for _, counter := range podTrafficCounters {
+			ch <- prometheus.MustNewConstMetric(counter.desc, prometheus.CounterValue, float64(counter.value(stats)),
+				key.resource, key.lowerDevice, key.namespace, key.pod)
+		}
+	}
+}
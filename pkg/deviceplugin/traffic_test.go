@@ -0,0 +1,116 @@
+package deviceplugin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vishvananda/netlink"
+
+	"github.com/kubevirt/macvtap-cni/pkg/devinfo"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pod traffic collector", func() {
+	const resourceName = resourceNamespace + "/dataplane"
+
+	var (
+		server        *fakePodResourcesServer
+		collector     *PodTrafficCollector
+		originalDPDir string
+		read          []string
+	)
+
+	saveDeviceInfo := func(id string, tap devinfo.TapDevice) {
+		Expect(devinfo.SaveForDP(resourceName, id, &devinfo.DeviceInfo{
+			Type:    "macvtap",
+			Version: devinfo.Version,
+			Tap:     &tap,
+		})).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		server = startFakePodResourcesServer()
+		originalDPDir = devinfo.DPDir
+		dpDir, err := os.MkdirTemp("", "devinfo")
+		Expect(err).NotTo(HaveOccurred())
+		devinfo.DPDir = dpDir
+
+		read = nil
+		collector = NewPodTrafficCollector(server.socket)
+		collector.readStats = func(netns, ifName string) (*netlink.LinkStatistics, error) {
+			read = append(read, netns+" "+ifName)
+			if netns == "/var/run/netns/gone" {
+				return nil, fmt.Errorf("no such netns")
+			}
+			return &netlink.LinkStatistics{
+				RxBytes: 1000, TxBytes: 2000,
+				RxPackets: 10, TxPackets: 20,
+				RxErrors: 1, TxErrors: 2,
+				RxDropped: 3, TxDropped: 4,
+			}, nil
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(devinfo.DPDir)
+		devinfo.DPDir = originalDPDir
+		server.stop()
+		owners.update(nil)
+	})
+
+	It("SHOULD report the statistics of the links allocated to pods", func() {
+		server.setDevices(resourceName, map[string][]string{
+			"compute": {"dataplaneMvp0", "dataplaneMvp1", "dataplaneMvp2"},
+		})
+		saveDeviceInfo("dataplaneMvp0", devinfo.TapDevice{IfIndex: 10, LowerDevice: "eth0", NetNS: "/var/run/netns/pod", IfName: "net1"})
+		saveDeviceInfo("dataplaneMvp1", devinfo.TapDevice{IfIndex: 11, LowerDevice: "eth0", NetNS: "/var/run/netns/pod", IfName: "net2"})
+		saveDeviceInfo("dataplaneMvp2", devinfo.TapDevice{IfIndex: 12, LowerDevice: "eth1", NetNS: "/var/run/netns/pod", IfName: "net3"})
+
+		labels := `{lower_device="%s",namespace="default",pod="virt-launcher",resource="` + resourceName + `"}`
+		expected := fmt.Sprintf(`
+# HELP macvtap_deviceplugin_pod_receive_bytes_total Number of bytes received by the links allocated to the pod.
+# TYPE macvtap_deviceplugin_pod_receive_bytes_total counter
+macvtap_deviceplugin_pod_receive_bytes_total`+labels+` 2000
+macvtap_deviceplugin_pod_receive_bytes_total`+labels+` 1000
+# HELP macvtap_deviceplugin_pod_transmit_drops_total Number of transmitted packets dropped by the links allocated to the pod.
+# TYPE macvtap_deviceplugin_pod_transmit_drops_total counter
+macvtap_deviceplugin_pod_transmit_drops_total`+labels+` 8
+macvtap_deviceplugin_pod_transmit_drops_total`+labels+` 4
+`, "eth0", "eth1", "eth0", "eth1")
+		Expect(testutil.CollectAndCompare(collector, strings.NewReader(expected),
+			"macvtap_deviceplugin_pod_receive_bytes_total",
+			"macvtap_deviceplugin_pod_transmit_drops_total",
+		)).To(Succeed())
+		Expect(testutil.CollectAndCount(collector)).To(Equal(16))
+		Expect(read).To(ConsistOf(
+			"/var/run/netns/pod net1", "/var/run/netns/pod net2", "/var/run/netns/pod net3",
+			"/var/run/netns/pod net1", "/var/run/netns/pod net2", "/var/run/netns/pod net3",
+		))
+	})
+
+	It("SHOULD skip the links not moved into their pod or unreadable", func() {
+		server.setDevices(resourceName, map[string][]string{
+			"compute": {"dataplaneMvp0", "dataplaneMvp1", "dataplaneMvp2"},
+		})
+		saveDeviceInfo("dataplaneMvp0", devinfo.TapDevice{IfIndex: 10, LowerDevice: "eth0"})
+		saveDeviceInfo("dataplaneMvp1", devinfo.TapDevice{IfIndex: 11, LowerDevice: "eth0", NetNS: "/var/run/netns/gone", IfName: "net1"})
+
+		Expect(testutil.CollectAndCount(collector)).To(BeZero())
+		Expect(read).To(ConsistOf("/var/run/netns/gone net1"))
+	})
+
+	It("SHOULD use the last known owners when the PodResources API is not available", func() {
+		server.setDevices(resourceName, map[string][]string{
+			"compute": {"dataplaneMvp0"},
+		})
+		saveDeviceInfo("dataplaneMvp0", devinfo.TapDevice{IfIndex: 10, LowerDevice: "eth0", NetNS: "/var/run/netns/pod", IfName: "net1"})
+		Expect(testutil.CollectAndCount(collector)).To(Equal(8))
+
+		server.stop()
+		Expect(testutil.CollectAndCount(collector)).To(Equal(8))
+	})
+})
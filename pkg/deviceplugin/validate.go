@@ -0,0 +1,175 @@
+package deviceplugin
+
+import (
+	"errors"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+// maxIfNameLen is the maximum length of a link name, IFNAMSIZ without the
+// terminating NUL.
+const maxIfNameLen = 15
+
+// ParseConfig reads and validates a configuration: the resources shared by
+// all nodes, and those of the nodes each override applies to. It returns the
+// shared resources. Validation errors are reported for every faulty entry.
+func ParseConfig(data []byte) ([]Config, error) {
+	return ParseNodeConfig(data, nil)
+}
+
+// ParseNodeConfig reads and validates a configuration, and returns the
+// resources of the given node.
+func ParseNodeConfig(data []byte, node *NodeSource) ([]Config, error) {
+	file, err := parseConfigFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	configs, err := mergeResources(file.Resources)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	if err = ValidateConfigs(configs); err != nil {
+		return nil, err
+	}
+	if err = file.validateOverrides(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%v", err)
+	}
+	if node == nil {
+		return configs, nil
+	}
+	if configs, err = file.forNode(node); err != nil {
+		return nil, err
+	}
+	if err = ValidateConfigs(configs); err != nil {
+		return nil, fmt.Errorf("node %s: %v", node.Name, err)
+	}
+	return configs, nil
+}
+
+// ValidateConfigs checks a list of resources. The returned error details the
+// problems of every faulty entry.
+func ValidateConfigs(configs []Config) error {
+	var errs []error
+	seen := make(map[string]int, len(configs))
+	for i, cfg := range configs {
+		entry := fmt.Sprintf("entry %d", i)
+		if cfg.Name != "" {
+			entry = fmt.Sprintf("entry %d (%s)", i, cfg.Name)
+		}
+		if first, duplicate := seen[cfg.Name]; duplicate && cfg.Name != "" {
+			errs = append(errs, fmt.Errorf("%s: duplicate name, also used by entry %d", entry, first))
+		} else {
+			seen[cfg.Name] = i
+		}
+		for _, err := range validateConfig(cfg) {
+			errs = append(errs, fmt.Errorf("%s: %v", entry, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%v", errors.Join(errs...))
+	}
+	return nil
+}
+
+func validateConfig(cfg Config) []error {
+	var errs []error
+
+	if cfg.Name == "" {
+		errs = append(errs, errors.New("name is required"))
+	} else {
+		for _, msg := range validation.IsQualifiedName(resourceNamespace + "/" + cfg.Name) {
+			errs = append(errs, fmt.Errorf("invalid name: %s", msg))
+		}
+	}
+
+	lowerSources := 0
+	for _, set := range []bool{cfg.LowerDevice != "", len(cfg.LowerDevices) > 0, cfg.Selectors != nil} {
+		if set {
+			lowerSources++
+		}
+	}
+	switch {
+	case lowerSources == 0:
+		errs = append(errs, errors.New("one of lowerDevice, lowerDevices or selectors is required"))
+	case lowerSources > 1:
+		errs = append(errs, errors.New("only one of lowerDevice, lowerDevices or selectors can be set"))
+	}
+	for _, lowerDevice := range cfg.LowerDevices {
+		if lowerDevice == "" {
+			errs = append(errs, errors.New("lowerDevices can not contain empty names"))
+		}
+	}
+	if cfg.Selectors != nil {
+		if err := cfg.Selectors.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	switch cfg.Type {
+	case "", util.TypeMacvtap:
+		if _, err := util.ModeFromString(cfg.Mode); err != nil {
+			errs = append(errs, err)
+		}
+	case util.TypeIPVtap:
+		if _, err := util.IPVlanModeFromString(cfg.Mode); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown type %q, expected %s or %s", cfg.Type, util.TypeMacvtap, util.TypeIPVtap))
+	}
+
+	if cfg.Capacity < 0 {
+		errs = append(errs, fmt.Errorf("capacity %d can not be negative", cfg.Capacity))
+	}
+	// A lower device takes a single passthru macvtap
+	if lowerDevices := len(cfg.lowerDevices()); cfg.Mode == modePassthru && cfg.Selectors == nil && cfg.Capacity > lowerDevices {
+		errs = append(errs, fmt.Errorf("capacity %d exceeds the %d lower devices in passthru mode, which takes one lower device per device", cfg.Capacity, lowerDevices))
+	}
+	if cfg.Queues < 0 || cfg.Queues > util.MaxQueues {
+		errs = append(errs, fmt.Errorf("queues %d must be within 0-%d", cfg.Queues, util.MaxQueues))
+	}
+
+	if _, ok := NewAllocationPolicy(cfg.AllocationPolicy); !ok {
+		errs = append(errs, fmt.Errorf("unknown allocationPolicy %q", cfg.AllocationPolicy))
+	}
+	switch cfg.LowerDeviceStrategy {
+	case "", LowerDeviceStrategyRoundRobin, LowerDeviceStrategyLeastUsed, LowerDeviceStrategyFirstHealthy:
+	default:
+		errs = append(errs, fmt.Errorf("unknown lowerDeviceStrategy %q", cfg.LowerDeviceStrategy))
+	}
+
+	errs = append(errs, validateLinkNames(cfg)...)
+	return errs
+}
+
+// validateLinkNames checks that the names of the links the plugin creates for
+// the resource fit in IFNAMSIZ.
+func validateLinkNames(cfg Config) []error {
+	var errs []error
+
+	capacity := cfg.capacity()
+	resourceName := cfg.Name
+	vlanID := ""
+	if cfg.VLAN != nil {
+		vlanID = fmt.Sprint(cfg.VLAN.To)
+		resourceName = fmt.Sprintf("%s-%s", cfg.Name, vlanID)
+	}
+	if device := fmt.Sprint(resourceName, suffix, capacity-1); len(device) > maxIfNameLen {
+		errs = append(errs, fmt.Errorf("device name %s is longer than %d characters, shorten the name or lower the capacity", device, maxIfNameLen))
+	}
+
+	if vlanID != "" {
+		for _, lowerDevice := range cfg.lowerDevices() {
+			if lowerDevice == "" {
+				continue
+			}
+			if link := vlanLinkName(lowerDevice, cfg.VLAN.To); len(link) > maxIfNameLen {
+				errs = append(errs, fmt.Errorf("VLAN sub-interface name %s is longer than %d characters", link, maxIfNameLen))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,108 @@
+package deviceplugin
+
+import (
+	"context"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Configuration validation", func() {
+	parse := func(config string) error {
+		_, err := ParseConfig([]byte(config))
+		return err
+	}
+
+	It("SHOULD accept a valid configuration", func() {
+		configs, err := ParseConfig([]byte(`[
+			{"name":"dataplane","lowerDevice":"eth0","mode":"bridge","capacity":50},
+			{"name":"storage","lowerDevices":["eth1","eth2"],"type":"ipvtap","mode":"l3","lowerDeviceStrategy":"least-used"},
+			{"name":"fast","selectors":{"drivers":["ice"]},"allocationPolicy":"least-recently-used","queues":4}
+		]`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(configs).To(HaveLen(3))
+	})
+
+	It("SHOULD accept an empty configuration", func() {
+		Expect(parse(`[]`)).To(Succeed())
+	})
+
+	It("SHOULD reject malformed JSON", func() {
+		Expect(parse(`[{"name":`)).To(MatchError(ContainSubstring("invalid configuration")))
+	})
+
+	Context("WHEN an entry is invalid", func() {
+		invalid := []struct{ description, config, message string }{
+			{"without name", `[{"lowerDevice":"eth0"}]`, "entry 0: name is required"},
+			{"with an invalid name", `[{"name":"data plane","lowerDevice":"eth0"}]`, "entry 0 (data plane): invalid name"},
+			{"with a duplicate name", `[{"name":"dataplane","lowerDevice":"eth0"},{"name":"dataplane","lowerDevice":"eth1"}]`, "entry 1 (dataplane): duplicate name, also used by entry 0"},
+			{"without lower device", `[{"name":"dataplane"}]`, "one of lowerDevice, lowerDevices or selectors is required"},
+			{"with several lower device sources", `[{"name":"dataplane","lowerDevice":"eth0","lowerDevices":["eth1"]}]`, "only one of lowerDevice, lowerDevices or selectors can be set"},
+			{"with an empty lower device", `[{"name":"dataplane","lowerDevices":["eth0",""]}]`, "lowerDevices can not contain empty names"},
+			{"with invalid selectors", `[{"name":"dataplane","selectors":{"ifNames":["ens("]}}]`, "invalid ifNames selector"},
+			{"with an unknown macvtap mode", `[{"name":"dataplane","lowerDevice":"eth0","mode":"l3"}]`, `unknown macvtap mode: "l3"`},
+			{"with an unknown ipvtap mode", `[{"name":"dataplane","lowerDevice":"eth0","type":"ipvtap","mode":"bridge"}]`, `unknown ipvtap mode: "bridge"`},
+			{"with an unknown type", `[{"name":"dataplane","lowerDevice":"eth0","type":"macvlan"}]`, `unknown type "macvlan"`},
+			{"with a negative capacity", `[{"name":"dataplane","lowerDevice":"eth0","capacity":-1}]`, "capacity -1 can not be negative"},
+			{"with a passthru capacity over the lower devices", `[{"name":"dataplane","lowerDevices":["eth0","eth1"],"mode":"passthru","capacity":3}]`,
+				"capacity 3 exceeds the 2 lower devices in passthru mode"},
+			{"with too many queues", `[{"name":"dataplane","lowerDevice":"eth0","queues":1000}]`, "queues 1000 must be within"},
+			{"with an unknown allocation policy", `[{"name":"dataplane","lowerDevice":"eth0","allocationPolicy":"packed"}]`, `unknown allocationPolicy "packed"`},
+			{"with an unknown lower device strategy", `[{"name":"dataplane","lowerDevices":["eth0"],"lowerDeviceStrategy":"random"}]`, `unknown lowerDeviceStrategy "random"`},
+			{"with device names too long", `[{"name":"dataplane-fast","lowerDevice":"eth0"}]`, "device name dataplane-fastMvp99 is longer than 15 characters"},
+			{"with VLAN device names too long", `[{"name":"dataplane","lowerDevice":"eth0","vlan":"100-200"}]`, "device name dataplane-200Mvp99 is longer than 15 characters"},
+			{"with VLAN sub-interface names too long", `[{"name":"dp","lowerDevice":"enp175s0f1np1","vlan":100,"capacity":10}]`, "VLAN sub-interface name enp175s0f1np1.100 is longer than 15 characters"},
+		}
+		for _, c := range invalid {
+			c := c
+			It("SHOULD reject it "+c.description, func() {
+				Expect(parse(c.config)).To(MatchError(ContainSubstring(c.message)))
+			})
+		}
+	})
+
+	It("SHOULD report the errors of every entry", func() {
+		err := parse(`[{"name":"a","lowerDevice":"eth0","mode":"bogus"},{"name":"b","lowerDevice":"eth0","capacity":-1}]`)
+		Expect(err).To(MatchError(ContainSubstring("entry 0 (a)")))
+		Expect(err).To(MatchError(ContainSubstring("entry 1 (b)")))
+	})
+
+	Context("WHEN a reloaded configuration is rejected", func() {
+		var originalEvents NodeEventRecorder
+
+		BeforeEach(func() {
+			originalEvents = Events
+		})
+
+		AfterEach(func() {
+			Events = originalEvents
+		})
+
+		It("SHOULD count it and record an Event on the node", func() {
+			client := fake.NewSimpleClientset()
+			Events = NewNodeEventRecorder(client, "node01")
+			errors0 := testutil.ToFloat64(configReloadErrors)
+
+			configRejected(errors.New("invalid configuration"))
+
+			Expect(testutil.ToFloat64(configReloadErrors)).To(Equal(errors0 + 1))
+			Eventually(func() []corev1.Event {
+				events, err := client.CoreV1().Events(metav1.NamespaceDefault).List(context.Background(), metav1.ListOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				return events.Items
+			}).Should(ConsistOf(And(
+				HaveField("Type", corev1.EventTypeWarning),
+				HaveField("Reason", ReasonInvalidConfiguration),
+				HaveField("Message", "invalid configuration"),
+				HaveField("InvolvedObject.Kind", "Node"),
+				HaveField("InvolvedObject.Name", "node01"),
+			)))
+		})
+	})
+})
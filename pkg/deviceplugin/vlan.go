@@ -0,0 +1,168 @@
+package deviceplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/golang/glog"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+const (
+	minVlanID = 1
+	maxVlanID = 4094
+)
+
+// VlanRange is a range of 802.1Q VLAN IDs. In the configuration it is given
+// either as a single ID, 100 or "100", or as an inclusive range, "100-110".
+type VlanRange struct {
+	From int
+	To   int
+}
+
+func (r *VlanRange) UnmarshalJSON(data []byte) error {
+	var id int
+	if err := json.Unmarshal(data, &id); err == nil {
+		r.From, r.To = id, id
+		return r.validate()
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("vlan must be an ID or a range of IDs: %s", data)
+	}
+	parsed, err := parseVlanRange(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+func (r VlanRange) MarshalJSON() ([]byte, error) {
+	if r.From == r.To {
+		return json.Marshal(r.From)
+	}
+	return json.Marshal(fmt.Sprintf("%d-%d", r.From, r.To))
+}
+
+func parseVlanRange(s string) (VlanRange, error) {
+	var r VlanRange
+	bounds := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return r, fmt.Errorf("invalid vlan %q: %v", s, err)
+	}
+	to := from
+	if len(bounds) == 2 {
+		to, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return r, fmt.Errorf("invalid vlan %q: %v", s, err)
+		}
+	}
+	r.From, r.To = from, to
+	return r, r.validate()
+}
+
+func (r VlanRange) validate() error {
+	if r.From < minVlanID || r.To > maxVlanID || r.From > r.To {
+		return fmt.Errorf("invalid vlan range %d-%d: IDs must be within %d-%d", r.From, r.To, minVlanID, maxVlanID)
+	}
+	return nil
+}
+
+// vlanLinkName is the name of the VLAN sub-interface of parent with the given
+// VLAN ID.
+func vlanLinkName(parent string, vlanID int) string {
+	return fmt.Sprintf("%s.%d", parent, vlanID)
+}
+
+// expandVlans replaces every configuration that has a VLAN range with one
+// configuration per VLAN ID. Each of them is named <name>-<id> and uses the
+// VLAN sub-interfaces of the configured lower devices as macvtap parents.
+func expandVlans(configs map[string]Config) map[string]Config {
+	expanded := make(map[string]Config, len(configs))
+	for name, cfg := range configs {
+		if cfg.VLAN == nil {
+			expanded[name] = cfg
+			continue
+		}
+		parents := cfg.lowerDevices()
+		for id := cfg.VLAN.From; id <= cfg.VLAN.To; id++ {
+			vlanCfg := cfg
+			vlanCfg.Name = fmt.Sprintf("%s-%d", cfg.Name, id)
+			subInterfaces := make([]string, 0, len(parents))
+			for _, parent := range parents {
+				subInterfaces = append(subInterfaces, vlanLinkName(parent, id))
+			}
+			if len(cfg.LowerDevices) > 0 {
+				vlanCfg.LowerDevices = subInterfaces
+			} else {
+				vlanCfg.LowerDevice = subInterfaces[0]
+			}
+			vlanCfg.VLAN = nil
+			vlanCfg.vlanParents = parents
+			vlanCfg.vlanID = id
+			expanded[vlanCfg.Name] = vlanCfg
+		}
+	}
+	return expanded
+}
+
+// ensureVlanLink creates the VLAN sub-interfaces backing the configuration, if
+// any, in the given namespace.
+func ensureVlanLink(cfg Config, netNsPath string) error {
+	if len(cfg.vlanParents) == 0 {
+		return nil
+	}
+	return ns.WithNetNSPath(netNsPath, func(_ ns.NetNS) error {
+		for i, lowerDevice := range cfg.lowerDevices() {
+			glog.V(3).Infof("Ensure VLAN sub-interface %s with ID %d on %s", lowerDevice, cfg.vlanID, cfg.vlanParents[i])
+			if err := util.EnsureVlan(lowerDevice, cfg.vlanParents[i], cfg.vlanID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// linksInUse returns the links the given configurations create their devices
+// on.
+func linksInUse(configs map[string]Config) map[string]bool {
+	inUse := make(map[string]bool)
+	for _, cfg := range configs {
+		for _, lowerDevice := range cfg.lowerDevices() {
+			inUse[lowerDevice] = true
+		}
+	}
+	return inUse
+}
+
+// deleteVlanLink deletes the VLAN sub-interfaces backing the configuration, if
+// any, from the given namespace. Only links created by the plugin are deleted,
+// and not those still in use by other resources, as resources using the same
+// VLAN on the same parent share its sub-interface.
+func deleteVlanLink(cfg Config, netNsPath string, inUse map[string]bool) error {
+	var unused []string
+	for _, lowerDevice := range cfg.lowerDevices() {
+		if len(cfg.vlanParents) > 0 && !inUse[lowerDevice] {
+			unused = append(unused, lowerDevice)
+		}
+	}
+	if len(unused) == 0 {
+		return nil
+	}
+	return ns.WithNetNSPath(netNsPath, func(_ ns.NetNS) error {
+		for _, lowerDevice := range unused {
+			glog.Infof("Delete VLAN sub-interface %s", lowerDevice)
+			if err := util.DeleteOwnedLink(lowerDevice); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,174 @@
+package deviceplugin
+
+import (
+	"encoding/json"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("VLAN", func() {
+	Context("WHEN parsing the vlan of a configuration", func() {
+		parse := func(vlan string) (*VlanRange, error) {
+			var cfg Config
+			err := json.Unmarshal([]byte(`{"name":"dataplane","lowerDevice":"eth0","vlan":`+vlan+`}`), &cfg)
+			return cfg.VLAN, err
+		}
+
+		It("SHOULD accept a single ID as a number", func() {
+			vlan, err := parse(`100`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*vlan).To(Equal(VlanRange{From: 100, To: 100}))
+		})
+
+		It("SHOULD accept a single ID as a string", func() {
+			vlan, err := parse(`"100"`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*vlan).To(Equal(VlanRange{From: 100, To: 100}))
+		})
+
+		It("SHOULD accept a range", func() {
+			vlan, err := parse(`"100-102"`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*vlan).To(Equal(VlanRange{From: 100, To: 102}))
+		})
+
+		It("SHOULD reject invalid IDs and ranges", func() {
+			for _, vlan := range []string{`0`, `4095`, `"102-100"`, `"a-b"`, `true`} {
+				_, err := parse(vlan)
+				Expect(err).To(HaveOccurred(), vlan)
+			}
+		})
+	})
+
+	Context("WHEN expanding configurations", func() {
+		It("SHOULD offer one resource per VLAN on top of its sub-interface", func() {
+			configs := map[string]Config{
+				"plain":     {Name: "plain", LowerDevice: "eth1", Mode: "bridge", Capacity: 10},
+				"dataplane": {Name: "dataplane", LowerDevice: "eth0", Mode: "vepa", Capacity: 20, VLAN: &VlanRange{From: 100, To: 101}},
+			}
+
+			expanded := expandVlans(configs)
+			Expect(expanded).To(HaveLen(3))
+			Expect(expanded["plain"]).To(Equal(configs["plain"]))
+			Expect(expanded["dataplane-100"]).To(Equal(Config{
+				Name:        "dataplane-100",
+				LowerDevice: "eth0.100",
+				Mode:        "vepa",
+				Capacity:    20,
+				vlanParents: []string{"eth0"},
+				vlanID:      100,
+			}))
+			Expect(expanded["dataplane-101"].LowerDevice).To(Equal("eth0.101"))
+			Expect(expanded["dataplane-101"].vlanID).To(Equal(101))
+		})
+
+		It("SHOULD back a per-VLAN resource with the sub-interfaces of every lower device", func() {
+			configs := map[string]Config{
+				"dataplane": {Name: "dataplane", LowerDevices: []string{"eth0", "eth1"}, VLAN: &VlanRange{From: 100, To: 100}},
+			}
+
+			expanded := expandVlans(configs)
+			Expect(expanded).To(HaveLen(1))
+			Expect(expanded["dataplane-100"].LowerDevices).To(Equal([]string{"eth0.100", "eth1.100"}))
+			Expect(expanded["dataplane-100"].vlanParents).To(Equal([]string{"eth0", "eth1"}))
+			Expect(configs["dataplane"].LowerDevices).To(Equal([]string{"eth0", "eth1"}))
+		})
+	})
+
+	Context("WHEN applying configurations", func() {
+		It("SHOULD not offer a resource whose VLAN sub-interface can not be created", func() {
+			ml := NewMacvtapLister("/nonexistent/netns", ListerTypeConfigEnv)
+			configs := expandVlans(map[string]Config{
+				"plain":     {Name: "plain", LowerDevice: "eth1"},
+				"dataplane": {Name: "dataplane", LowerDevice: "eth0", VLAN: &VlanRange{From: 100, To: 100}},
+			})
+
+			ml.Lock()
+			defer ml.Unlock()
+			plugins, changed, err := ml.applyConfigs(configs)
+			Expect(err).To(MatchError(ContainSubstring("resource dataplane-100: error creating VLAN sub-interface")))
+			Expect(plugins).To(ConsistOf("plain"))
+			Expect(changed).To(BeTrue())
+			Expect(ml.Config).To(HaveKey("plain"))
+			Expect(ml.Config).NotTo(HaveKey("dataplane-100"))
+		})
+	})
+
+	Context("WHEN removing resources on a VLAN sub-interface", func() {
+		const parent = "vlanparent"
+
+		var (
+			testNs ns.NetNS
+			ml     *macvtapLister
+		)
+
+		apply := func(configs map[string]Config) {
+			ml.Lock()
+			defer ml.Unlock()
+			_, _, err := ml.applyConfigs(expandVlans(configs))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		vlanLinkExists := func() bool {
+			var exists bool
+			Expect(testNs.Do(func(_ ns.NetNS) error {
+				var err error
+				exists, err = util.LinkExists(vlanLinkName(parent, 100))
+				return err
+			})).To(Succeed())
+			return exists
+		}
+
+		BeforeEach(func() {
+			var err error
+			testNs, err = testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name:      parent,
+					Namespace: netlink.NsFd(int(testNs.Fd())),
+				},
+			})).To(Succeed())
+			ml = NewMacvtapLister(testNs.Path(), ListerTypeConfigEnv)
+		})
+
+		AfterEach(func() {
+			Expect(testNs.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(testNs)).To(Succeed())
+		})
+
+		It("SHOULD keep the sub-interface of a renamed resource", func() {
+			apply(map[string]Config{"a": {Name: "a", LowerDevice: parent, VLAN: &VlanRange{From: 100, To: 100}}})
+			Expect(vlanLinkExists()).To(BeTrue())
+
+			apply(map[string]Config{"c": {Name: "c", LowerDevice: parent, VLAN: &VlanRange{From: 100, To: 100}}})
+			Expect(vlanLinkExists()).To(BeTrue())
+			Expect(ml.Config).To(HaveKey("c-100"))
+			Expect(ml.Config).NotTo(HaveKey("a-100"))
+
+			apply(map[string]Config{})
+			Expect(vlanLinkExists()).To(BeFalse())
+		})
+
+		It("SHOULD keep the sub-interface another resource uses", func() {
+			apply(map[string]Config{
+				"a": {Name: "a", LowerDevice: parent, VLAN: &VlanRange{From: 100, To: 100}},
+				"b": {Name: "b", LowerDevice: parent, VLAN: &VlanRange{From: 100, To: 100}, Mode: "vepa"},
+			})
+			Expect(vlanLinkExists()).To(BeTrue())
+
+			apply(map[string]Config{"a": {Name: "a", LowerDevice: parent, VLAN: &VlanRange{From: 100, To: 100}}})
+			Expect(vlanLinkExists()).To(BeTrue())
+
+			apply(map[string]Config{})
+			Expect(vlanLinkExists()).To(BeFalse())
+		})
+	})
+})
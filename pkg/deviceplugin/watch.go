@@ -0,0 +1,122 @@
+package deviceplugin
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// configDebounce is how long the configuration file must be left untouched
+// before it is read again.
+var configDebounce = 500 * time.Millisecond
+
+// kubeletDataDir is the symlink the kubelet swaps to update the files of a
+// ConfigMap volume at once.
+const kubeletDataDir = "..data"
+
+// configFileWatcher notifies changes of the content of a configuration file.
+// It watches the parent directory rather than the file, so that it survives
+// the file being replaced, as the kubelet does for ConfigMap volumes by
+// swapping the ..data symlink the file links to.
+type configFileWatcher struct {
+	path      string
+	debounce  time.Duration
+	fsWatcher *fsnotify.Watcher
+	hash      [sha256.Size]byte
+}
+
+func newConfigFileWatcher(path string, debounce time.Duration) (*configFileWatcher, error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = fsWatcher.Add(filepath.Dir(path)); err != nil {
+		fsWatcher.Close()
+		return nil, err
+	}
+	return &configFileWatcher{
+		path:      path,
+		debounce:  debounce,
+		fsWatcher: fsWatcher,
+	}, nil
+}
+
+func (w *configFileWatcher) Close() error {
+	return w.fsWatcher.Close()
+}
+
+// read returns the content of the file, and whether it changed since the
+// previous read.
+func (w *configFileWatcher) read() ([]byte, bool, error) {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return nil, false, err
+	}
+	hash := sha256.Sum256(data)
+	changed := hash != w.hash
+	w.hash = hash
+	if changed {
+		if target, err := filepath.EvalSymlinks(w.path); err == nil && target != w.path {
+			glog.V(3).Infof("Configuration %s changed, read from %s", w.path, target)
+		} else {
+			glog.V(3).Infof("Configuration %s changed", w.path)
+		}
+	}
+	return data, changed, nil
+}
+
+// concerns tells whether an event of the parent directory may change the
+// content of the file.
+func (w *configFileWatcher) concerns(event fsnotify.Event) bool {
+	name := filepath.Clean(event.Name)
+	return name == filepath.Clean(w.path) || filepath.Base(name) == kubeletDataDir
+}
+
+// run sends the content of the file on changes until stopped. Bursts of
+// events are coalesced, and content identical to the previous one is not
+// sent. The changes channel is closed when the watch fails.
+func (w *configFileWatcher) run(changes chan<- []byte, stop <-chan struct{}) {
+	defer close(changes)
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case event, open := <-w.fsWatcher.Events:
+			if !open {
+				glog.Error("config watcher event channel closed")
+				return
+			}
+			if w.concerns(event) {
+				glog.V(4).Infof("Config watcher event %s", event)
+				settled = time.After(w.debounce)
+			}
+		case <-settled:
+			settled = nil
+			data, changed, err := w.read()
+			if err != nil {
+				glog.Errorf("Error reading config[Path:%s]: %v", w.path, err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			select {
+			case changes <- data:
+			case <-stop:
+				return
+			}
+		case err, open := <-w.fsWatcher.Errors:
+			if !open {
+				glog.Error("config watcher error channel closed")
+				return
+			}
+			glog.Errorf("configmap watching error: %v", err)
+		}
+	}
+}
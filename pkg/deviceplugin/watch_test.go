@@ -0,0 +1,96 @@
+package deviceplugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Configuration file watcher", func() {
+	const debounce = 50 * time.Millisecond
+
+	var (
+		dir     string
+		path    string
+		watcher *configFileWatcher
+		changes chan []byte
+		stop    chan struct{}
+		version int
+	)
+
+	// update writes a new version of the file the way the kubelet updates
+	// ConfigMap volumes: in a new directory, then made current by
+	// renaming a new ..data symlink over the previous one.
+	update := func(content string) {
+		version++
+		versionDir := filepath.Join(dir, fmt.Sprintf("..v%d", version))
+		Expect(os.Mkdir(versionDir, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(versionDir, "config"), []byte(content), 0644)).To(Succeed())
+		tmp := filepath.Join(dir, "..data_tmp")
+		Expect(os.Symlink(filepath.Base(versionDir), tmp)).To(Succeed())
+		Expect(os.Rename(tmp, filepath.Join(dir, kubeletDataDir))).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "configmap")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "config")
+		update(`[]`)
+		Expect(os.Symlink(filepath.Join(kubeletDataDir, "config"), path)).To(Succeed())
+
+		watcher, err = newConfigFileWatcher(path, debounce)
+		Expect(err).NotTo(HaveOccurred())
+		data, changed, err := watcher.read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(string(data)).To(Equal(`[]`))
+
+		changes = make(chan []byte)
+		stop = make(chan struct{})
+		go watcher.run(changes, stop)
+	})
+
+	AfterEach(func() {
+		close(stop)
+		watcher.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("SHOULD follow the ..data symlink swaps", func() {
+		update(`[{"name":"dataplane","lowerDevice":"eth0"}]`)
+		Eventually(changes).Should(Receive(Equal([]byte(`[{"name":"dataplane","lowerDevice":"eth0"}]`))))
+
+		update(`[{"name":"dataplane","lowerDevice":"eth1"}]`)
+		Eventually(changes).Should(Receive(Equal([]byte(`[{"name":"dataplane","lowerDevice":"eth1"}]`))))
+	})
+
+	It("SHOULD coalesce a burst of updates", func() {
+		for _, lowerDevice := range []string{"eth0", "eth1", "eth2"} {
+			update(`[{"name":"dataplane","lowerDevice":"` + lowerDevice + `"}]`)
+		}
+		Eventually(changes).Should(Receive(Equal([]byte(`[{"name":"dataplane","lowerDevice":"eth2"}]`))))
+		Consistently(changes, 4*debounce).ShouldNot(Receive())
+	})
+
+	It("SHOULD not notify an unchanged content", func() {
+		update(`[]`)
+		Consistently(changes, 4*debounce).ShouldNot(Receive())
+	})
+
+	It("SHOULD follow a file written in place", func() {
+		Expect(os.Remove(path)).To(Succeed())
+		Expect(os.WriteFile(path, []byte(`[{"name":"dataplane","lowerDevice":"eth0"}]`), 0644)).To(Succeed())
+		Eventually(changes).Should(Receive(Equal([]byte(`[{"name":"dataplane","lowerDevice":"eth0"}]`))))
+	})
+
+	It("SHOULD stop when asked to", func() {
+		close(stop)
+		Eventually(changes).Should(BeClosed())
+		stop = make(chan struct{})
+	})
+})
@@ -0,0 +1,135 @@
+// Package devinfo reads and writes device information files as defined by the
+// Network Plumbing Working Group Device Information Specification.
+package devinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Version is the version of the specification the files comply with.
+	Version = "1.1.0"
+
+	baseDir = "/var/run/k8s.cni.cncf.io/devinfo"
+)
+
+// DPDir is the directory where device plugins publish the information of the
+// devices they allocate.
+var DPDir = filepath.Join(baseDir, "dp")
+
+// DeviceInfo is the information published for a macvtap or ipvtap device. Its
+// Type is the type of the device.
+type DeviceInfo struct {
+	Type    string     `json:"type"`
+	Version string     `json:"version"`
+	Tap     *TapDevice `json:"tap,omitempty"`
+}
+
+// TapDevice describes the tap device of a macvtap or ipvtap link.
+type TapDevice struct {
+	Path        string `json:"path"`
+	IfIndex     int    `json:"ifindex"`
+	LowerDevice string `json:"lower-device"`
+	Mode        string `json:"mode,omitempty"`
+	Queues      int    `json:"queues,omitempty"`
+	// NetNS and IfName are the netns and name of the link once moved into
+	// a pod, recorded in the information published by the device plugin
+	// only, so that it can read the statistics of the link.
+	NetNS  string `json:"netns,omitempty"`
+	IfName string `json:"ifname,omitempty"`
+}
+
+func dpFileName(resourceName, deviceID string) string {
+	return fmt.Sprintf("%s-%s-device.json", strings.ReplaceAll(resourceName, "/", "-"), strings.ReplaceAll(deviceID, "/", "-"))
+}
+
+// SaveForDP publishes the information of a device allocated for the given
+// resource.
+func SaveForDP(resourceName, deviceID string, info *DeviceInfo) error {
+	if err := os.MkdirAll(DPDir, 0755); err != nil {
+		return err
+	}
+	return SaveToFile(filepath.Join(DPDir, dpFileName(resourceName, deviceID)), info)
+}
+
+// LoadForDP returns the published information of a device allocated for the
+// given resource, or nil if there is none.
+func LoadForDP(resourceName, deviceID string) (*DeviceInfo, error) {
+	path := filepath.Join(DPDir, dpFileName(resourceName, deviceID))
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := &DeviceInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("failed to parse device info %q: %v", path, err)
+	}
+	return info, nil
+}
+
+// ListForDP returns, by device ID, the published information of the devices
+// allocated for the given resource. As file names are not delimited, it may
+// also return devices of other resources named <resourceName>-<suffix>, which
+// the caller should tell apart by their device ID.
+func ListForDP(resourceName string) (map[string]*DeviceInfo, error) {
+	entries, err := os.ReadDir(DPDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.ReplaceAll(resourceName, "/", "-") + "-"
+	const suffix = "-device.json"
+	infos := make(map[string]*DeviceInfo)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		deviceID := strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
+		info, err := LoadForDP(resourceName, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			infos[deviceID] = info
+		}
+	}
+	return infos, nil
+}
+
+// CleanForDP removes the published information of a device allocated for the
+// given resource.
+func CleanForDP(resourceName, deviceID string) error {
+	return CleanFile(filepath.Join(DPDir, dpFileName(resourceName, deviceID)))
+}
+
+// SaveToFile writes the device information to the given path.
+func SaveToFile(path string, info *DeviceInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// CleanFile removes a device information file, if it exists.
+func CleanFile(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -1,22 +1,37 @@
 package util
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/100"
 
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
 )
 
+const (
+	// ResourceNamespace is the namespace of the resources offered by the
+	// device plugin.
+	ResourceNamespace = "macvtap.network.kubevirt.io"
+	// DeviceNameInfix separates the resource name from the index in the names
+	// of the macvtap links created by the device plugin: <resource>Mvp<N>.
+	DeviceNameInfix = "Mvp"
+)
+
 func ModeFromString(s string) (netlink.MacvlanMode, error) {
 	switch s {
 	case "", "bridge":
@@ -25,12 +40,51 @@ func ModeFromString(s string) (netlink.MacvlanMode, error) {
 		return netlink.MACVLAN_MODE_PRIVATE, nil
 	case "vepa":
 		return netlink.MACVLAN_MODE_VEPA, nil
+	case "passthru":
+		return netlink.MACVLAN_MODE_PASSTHRU, nil
+	case "source":
+		return netlink.MACVLAN_MODE_SOURCE, nil
 	default:
 		return 0, fmt.Errorf("unknown macvtap mode: %q", s)
 	}
 }
 
-func CreateMacvtap(name string, lowerDevice string, mode string) (int, error) {
+// Types of the tap devices that can be created.
+const (
+	TypeMacvtap = "macvtap"
+	TypeIPVtap  = "ipvtap"
+)
+
+// IPVlanModeFromString returns the ipvlan mode named s, l2 by default.
+func IPVlanModeFromString(s string) (netlink.IPVlanMode, error) {
+	switch s {
+	case "", "l2":
+		return netlink.IPVLAN_MODE_L2, nil
+	case "l3":
+		return netlink.IPVLAN_MODE_L3, nil
+	case "l3s":
+		return netlink.IPVLAN_MODE_L3S, nil
+	default:
+		return 0, fmt.Errorf("unknown ipvtap mode: %q", s)
+	}
+}
+
+// isTap reports whether the link is a macvtap or an ipvtap.
+func isTap(link netlink.Link) bool {
+	switch link.(type) {
+	case *netlink.Macvtap, *netlink.IPVtap:
+		return true
+	}
+	return false
+}
+
+// MaxQueues is the maximum number of queues of a macvtap device.
+const MaxQueues = 256
+
+// CreateMacvtap creates a macvtap link on top of lowerDevice and sets it UP.
+// With queues greater than one, the link is created multiqueue so that its tap
+// device can be opened once per queue with IFF_MULTI_QUEUE.
+func CreateMacvtap(name string, lowerDevice string, mode string, queues int) (int, error) {
 	ifindex := 0
 
 	m, err := netlink.LinkByName(lowerDevice)
@@ -55,6 +109,14 @@ func CreateMacvtap(name string, lowerDevice string, mode string) (int, error) {
 		},
 	}
 
+	if queues > MaxQueues {
+		return ifindex, fmt.Errorf("invalid number of queues %d: at most %d are supported", queues, MaxQueues)
+	}
+	if queues > 1 {
+		mv.NumTxQueues = queues
+		mv.NumRxQueues = queues
+	}
+
 	if err := netlink.LinkAdd(mv); err != nil {
 		return ifindex, fmt.Errorf("failed to create macvtap: %v", err)
 	}
@@ -67,12 +129,180 @@ func CreateMacvtap(name string, lowerDevice string, mode string) (int, error) {
 	return ifindex, nil
 }
 
-func RecreateMacvtap(name string, lowerDevice string, mode string) (int, error) {
+// CreateIPVtap creates an ipvtap link on top of lowerDevice and sets it UP.
+// Queues are handled as in CreateMacvtap.
+func CreateIPVtap(name string, lowerDevice string, mode string, queues int) (int, error) {
+	m, err := netlink.LinkByName(lowerDevice)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lookup lowerDevice %q: %v", lowerDevice, err)
+	}
+
+	nlmode, err := IPVlanModeFromString(mode)
+	if err != nil {
+		return 0, err
+	}
+
+	iv := &netlink.IPVtap{
+		IPVlan: netlink.IPVlan{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:        name,
+				ParentIndex: m.Attrs().Index,
+				TxQLen:      m.Attrs().TxQLen,
+			},
+			Mode: nlmode,
+		},
+	}
+
+	if queues > MaxQueues {
+		return 0, fmt.Errorf("invalid number of queues %d: at most %d are supported", queues, MaxQueues)
+	}
+	if queues > 1 {
+		iv.NumTxQueues = queues
+		iv.NumRxQueues = queues
+	}
+
+	if err := netlink.LinkAdd(iv); err != nil {
+		return 0, fmt.Errorf("failed to create ipvtap: %v", err)
+	}
+
+	if err := netlink.LinkSetUp(iv); err != nil {
+		return 0, fmt.Errorf("failed to set %q UP: %v", name, err)
+	}
+
+	return iv.Attrs().Index, nil
+}
+
+var deviceNameRegexp = regexp.MustCompile("^(.+)" + DeviceNameInfix + "[0-9]+$")
+
+// ResourceNameFromDevice returns the full name of the resource a device named
+// after the device plugin naming scheme belongs to, or an empty string.
+func ResourceNameFromDevice(deviceID string) string {
+	match := deviceNameRegexp.FindStringSubmatch(deviceID)
+	if match == nil {
+		return ""
+	}
+	return ResourceNamespace + "/" + match[1]
+}
+
+// ValidateDevice checks that the link with the given name is a macvtap or
+// ipvtap created by the device plugin, so that it is safe to hand it over to a
+// container: it must be a macvtap or ipvtap, named <resource>Mvp<N> and, if
+// allowedParents is not empty, have one of those links as parent.
+func ValidateDevice(name string, allowedParents []string) error {
+	if !deviceNameRegexp.MatchString(name) {
+		return fmt.Errorf("device %q does not match the device plugin naming scheme <resource>%s<N>", name, DeviceNameInfix)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	if !isTap(link) {
+		return fmt.Errorf("device %q is of type %q, expected macvtap or ipvtap", name, link.Type())
+	}
+
+	if len(allowedParents) == 0 {
+		return nil
+	}
+
+	parent, err := netlink.LinkByIndex(link.Attrs().ParentIndex)
+	if err != nil {
+		return fmt.Errorf("failed to lookup parent of device %q: %v", name, err)
+	}
+	for _, allowed := range allowedParents {
+		if parent.Attrs().Name == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("device %q has parent %q, which is not an allowed lower device %v", name, parent.Attrs().Name, allowedParents)
+}
+
+// TemporaryMacvtapName returns a random name for a macvtap link that is meant
+// to be renamed once moved to its final netns.
+func TemporaryMacvtapName() string {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("mvtap%x", time.Now().UnixNano()&0xffffffff)
+	}
+	return fmt.Sprintf("mvtap%x", buf)
+}
+
+func RecreateMacvtap(name string, lowerDevice string, mode string, queues int) (int, error) {
 	err := LinkDelete(name)
 	if err != nil {
 		return 0, err
 	}
-	return CreateMacvtap(name, lowerDevice, mode)
+	return CreateMacvtap(name, lowerDevice, mode, queues)
+}
+
+func RecreateIPVtap(name string, lowerDevice string, mode string, queues int) (int, error) {
+	err := LinkDelete(name)
+	if err != nil {
+		return 0, err
+	}
+	return CreateIPVtap(name, lowerDevice, mode, queues)
+}
+
+// OwnerAlias is set as alias on the links created and owned by the device
+// plugin, other than the macvtap links it allocates.
+const OwnerAlias = "macvtap-deviceplugin"
+
+// EnsureVlan makes sure that a VLAN sub-interface with the given name and VLAN
+// ID exists on top of parent, creating it if needed. A created link is marked
+// as owned through OwnerAlias and set UP.
+func EnsureVlan(name string, parent string, vlanID int) error {
+	l, err := netlink.LinkByName(name)
+	if err == nil {
+		vlan, ok := l.(*netlink.Vlan)
+		if !ok || vlan.VlanId != vlanID {
+			return fmt.Errorf("link %q already exists and is not a VLAN sub-interface with ID %d", name, vlanID)
+		}
+		return nil
+	}
+	if _, ok := err.(netlink.LinkNotFoundError); !ok {
+		return err
+	}
+
+	p, err := netlink.LinkByName(parent)
+	if err != nil {
+		return fmt.Errorf("failed to lookup VLAN parent %q: %v", parent, err)
+	}
+
+	vlan := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: p.Attrs().Index,
+		},
+		VlanId: vlanID,
+	}
+	if err := netlink.LinkAdd(vlan); err != nil {
+		return fmt.Errorf("failed to create VLAN sub-interface %q: %v", name, err)
+	}
+	if err := netlink.LinkSetAlias(vlan, OwnerAlias); err != nil {
+		netlink.LinkDel(vlan)
+		return fmt.Errorf("failed to set alias on %q: %v", name, err)
+	}
+	if err := netlink.LinkSetUp(vlan); err != nil {
+		return fmt.Errorf("failed to set %q UP: %v", name, err)
+	}
+	return nil
+}
+
+// DeleteOwnedLink deletes the link with the given name, but only if it is
+// marked as owned through OwnerAlias.
+func DeleteOwnedLink(name string) error {
+	l, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if l.Attrs().Alias != OwnerAlias {
+		return nil
+	}
+	return netlink.LinkDel(l)
 }
 
 func LinkExists(link string) (bool, error) {
@@ -86,6 +316,39 @@ func LinkExists(link string) (bool, error) {
 	return true, nil
 }
 
+// LinkHealth tells whether a link can carry traffic for the macvtaps on top of
+// it, that is, whether it is up and has carrier. Otherwise, it also returns
+// the reason.
+func LinkHealth(link netlink.Link) (bool, string) {
+	attrs := link.Attrs()
+	if attrs.Flags&net.FlagUp == 0 {
+		return false, "is administratively down"
+	}
+	switch attrs.OperState {
+	case netlink.OperUp, netlink.OperUnknown:
+	default:
+		return false, fmt.Sprintf("is operationally %s", attrs.OperState)
+	}
+	if attrs.RawFlags&unix.IFF_LOWER_UP == 0 {
+		return false, "has no carrier"
+	}
+	return true, ""
+}
+
+// LowerDeviceHealth looks up a link by name and returns its health as
+// LinkHealth does. A missing link is unhealthy.
+func LowerDeviceHealth(name string) (bool, string, error) {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return false, "does not exist", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	healthy, reason := LinkHealth(link)
+	return healthy, reason, nil
+}
+
 func LinkDelete(link string) error {
 	l, err := netlink.LinkByName(link)
 	if _, ok := err.(netlink.LinkNotFoundError); ok {
@@ -98,6 +361,72 @@ func LinkDelete(link string) error {
 	return err
 }
 
+// DeleteMacvtapWithIndex deletes the macvtap or ipvtap link with the given
+// name, but only if it still has the given index. It reports whether a link
+// was deleted.
+func DeleteMacvtapWithIndex(name string, index int) (bool, error) {
+	l, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !isTap(l) || l.Attrs().Index != index {
+		return false, nil
+	}
+	return true, netlink.LinkDel(l)
+}
+
+// DeviceLink identifies a macvtap or ipvtap link created by the device plugin.
+type DeviceLink struct {
+	Name  string
+	Index int
+}
+
+// ListDeviceLinks returns the macvtap and ipvtap links named after the device
+// plugin naming scheme, <resource>Mvp<N>.
+func ListDeviceLinks() ([]DeviceLink, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var devices []DeviceLink
+	for _, link := range links {
+		if isTap(link) && deviceNameRegexp.MatchString(link.Attrs().Name) {
+			devices = append(devices, DeviceLink{Name: link.Attrs().Name, Index: link.Attrs().Index})
+		}
+	}
+	return devices, nil
+}
+
+// MacvtapSupported reports whether the running kernel provides macvtap, either
+// already loaded or built in, or as a module that can be loaded on demand.
+func MacvtapSupported() (bool, error) {
+	if _, err := os.Stat("/sys/class/macvtap"); err == nil {
+		return true, nil
+	}
+
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return false, err
+	}
+	release := unix.ByteSliceToString(uname.Release[:])
+	for _, file := range []string{"modules.builtin", "modules.dep"} {
+		data, err := os.ReadFile(filepath.Join("/lib/modules", release, file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if strings.Contains(string(data), "/macvtap.ko") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func isLoopback(link netlink.Link) bool {
 	return link.Attrs().Flags&net.FlagLoopback != 0
 }
@@ -134,11 +463,53 @@ func FindSuitableMacvtapParents() ([]string, error) {
 	return linkNames, nil
 }
 
-// OnLinkEvent listens for events on a specific interface and namespace, and
+// ParentLink describes a link suitable as macvtap parent.
+type ParentLink struct {
+	Name string
+	// Type is the netlink type of the link, such as device, bond or vlan.
+	Type string
+	// PermanentMAC is the permanent MAC address of the link, or its current
+	// MAC address if the kernel does not report one.
+	PermanentMAC string
+}
+
+// ListSuitableMacvtapParents returns the links deemed appropriate to be used
+// as macvtap parents, except those owned by the device plugin.
+func ListSuitableMacvtapParents() ([]ParentLink, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	var parents []ParentLink
+	for _, link := range links {
+		attrs := link.Attrs()
+		if !isSuitableMacvtapParent(link) || attrs.Alias == OwnerAlias {
+			continue
+		}
+		mac := attrs.PermHWAddr
+		if len(mac) == 0 {
+			mac = attrs.HardwareAddr
+		}
+		parents = append(parents, ParentLink{
+			Name:         attrs.Name,
+			Type:         link.Type(),
+			PermanentMAC: mac.String(),
+		})
+	}
+	return parents, nil
+}
+
+// OnLinkEvent listens for events on specific interfaces and namespace, and
 // callbacks if any. See onLinkEvent for more details.
-func OnLinkEvent(name string, nsPath string, do func(), stop <-chan struct{}, errcb func(error)) {
+func OnLinkEvent(names []string, nsPath string, do func(), stop <-chan struct{}, errcb func(error)) {
 	matcher := func(link netlink.Link) bool {
-		return name == link.Attrs().Name
+		for _, name := range names {
+			if name == link.Attrs().Name {
+				return true
+			}
+		}
+		return false
 	}
 
 	onLinkEvent(matcher, nsPath, do, stop, errcb)
@@ -151,6 +522,55 @@ func OnSuitableMacvtapParentEvent(nsPath string, do func(), stop <-chan struct{}
 	onLinkEvent(isSuitableMacvtapParent, nsPath, do, stop, errcb)
 }
 
+// subscriptionTracker tracks the link event subscriptions, and since when
+// those that are down have been down.
+type subscriptionTracker struct {
+	sync.Mutex
+	next int
+	down map[int]time.Time
+}
+
+var linkSubscriptions = &subscriptionTracker{down: make(map[int]time.Time)}
+
+// add tracks a new subscription, down until set up.
+func (t *subscriptionTracker) add() int {
+	t.Lock()
+	defer t.Unlock()
+	t.next++
+	t.down[t.next] = time.Now()
+	return t.next
+}
+
+func (t *subscriptionTracker) set(id int, up bool) {
+	t.Lock()
+	defer t.Unlock()
+	if up {
+		delete(t.down, id)
+	} else if _, down := t.down[id]; !down {
+		t.down[id] = time.Now()
+	}
+}
+
+func (t *subscriptionTracker) remove(id int) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.down, id)
+}
+
+// LinkSubscriptionsDownSince returns since when the link event subscription
+// down for the longest time has been down, or false if none is down.
+func LinkSubscriptionsDownSince() (time.Time, bool) {
+	linkSubscriptions.Lock()
+	defer linkSubscriptions.Unlock()
+	var since time.Time
+	for _, down := range linkSubscriptions.down {
+		if since.IsZero() || down.Before(since) {
+			since = down
+		}
+	}
+	return since, !since.IsZero()
+}
+
 // onLinkEvent upkeeps a subscription to netlink events and callbacks for any
 // that matches the predicate on the related link.
 // The subscription might temporarily fail. On re-subscription, the callback is
@@ -169,6 +589,9 @@ func onLinkEvent(match func(netlink.Link) bool, nsPath string, do func(), stop <
 	done := make(chan struct{})
 	defer close(done)
 
+	id := linkSubscriptions.add()
+	defer linkSubscriptions.remove(id)
+
 	options := netlink.LinkSubscribeOptions{
 		ListExisting: false,
 		ErrorCallback: func(err error) {
@@ -194,6 +617,7 @@ func onLinkEvent(match func(netlink.Link) bool, nsPath string, do func(), stop <
 			return
 		}
 		subscribed = true
+		linkSubscriptions.set(id, true)
 
 		// Callback on every subscription
 		do()
@@ -219,6 +643,8 @@ func onLinkEvent(match func(netlink.Link) bool, nsPath string, do func(), stop <
 				if match(update.Link) {
 					do()
 				}
+			} else {
+				linkSubscriptions.set(id, false)
 			}
 		case <-stop:
 			return
@@ -256,8 +682,9 @@ func ExecIPAMAdd(ipamType string, stdinData []byte) (*current.Result, error) {
 	return ipamResult, nil
 }
 
-// Move an existing macvtap interface from the current netns to the target netns, and rename it..
-// Optionally configure the MAC address of the interface and the link's MTU.
+// Move an existing macvtap or ipvtap interface from the current netns to the target netns, and rename it..
+// Optionally configure the MAC address of the interface and the link's MTU. The MAC address is
+// not configured on ipvtap interfaces.
 func ConfigureInterface(currentIfaceName string, newIfaceName string, macAddr *net.HardwareAddr, mtu int, promisc bool, netns ns.NetNS) (*current.Interface, error) {
 	var (
 		err          error
@@ -289,7 +716,10 @@ func ConfigureInterface(currentIfaceName string, newIfaceName string, macAddr *n
 			}
 		}
 
-		if macAddr != nil {
+		// ipvtap links share the MAC address of their lower device, which
+		// can not be changed from the container
+		_, isIPVtap := macvtapIface.(*netlink.IPVtap)
+		if macAddr != nil && !isIPVtap {
 			if err = netlink.LinkSetHardwareAddr(macvtapIface, *macAddr); err != nil {
 				return fmt.Errorf("failed to add hardware addr to %q: %v", currentIfaceName, err)
 			}
@@ -331,6 +761,109 @@ func ConfigureInterface(currentIfaceName string, newIfaceName string, macAddr *n
 	return macvtap, err
 }
 
+// ValidateInterface checks that the link named ifaceName in the current netns
+// is still a macvtap or ipvtap interface on top of the parent link with index
+// parentIndex, and that its MAC address, MTU and promiscuous mode match the
+// expected values. Zero values of parentIndex, macAddr and mtu are not
+// checked. The validated link is returned.
+func ValidateInterface(ifaceName string, parentIndex int, macAddr string, mtu int, promisc bool) (netlink.Link, error) {
+	link, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup device %q: %v", ifaceName, err)
+	}
+
+	if !isTap(link) {
+		return nil, fmt.Errorf("interface %q is of type %q, expected macvtap or ipvtap", ifaceName, link.Type())
+	}
+
+	if parentIndex != 0 && link.Attrs().ParentIndex != parentIndex {
+		return nil, fmt.Errorf("interface %q has parent index %d, expected %d", ifaceName, link.Attrs().ParentIndex, parentIndex)
+	}
+
+	if macAddr != "" && macAddr != link.Attrs().HardwareAddr.String() {
+		return nil, fmt.Errorf("interface %q has MAC address %s, expected %s", ifaceName, link.Attrs().HardwareAddr, macAddr)
+	}
+
+	if mtu != 0 && link.Attrs().MTU != mtu {
+		return nil, fmt.Errorf("interface %q has MTU %d, expected %d", ifaceName, link.Attrs().MTU, mtu)
+	}
+
+	if enabled := link.Attrs().Promisc != 0; enabled != promisc {
+		return nil, fmt.Errorf("interface %q has promiscuous mode %s, expected %s", ifaceName, onOff(enabled), onOff(promisc))
+	}
+
+	return link, nil
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+// SetSourceMACs programs the list of MAC addresses accepted by the macvtap link
+// with the given name in the current netns, if it is in source mode. The list
+// replaces any previously programmed one. It reports whether the link is in
+// source mode.
+func SetSourceMACs(name string, macs []net.HardwareAddr) (bool, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return false, fmt.Errorf("failed to lookup link %q: %v", name, err)
+	}
+	mv, ok := link.(*netlink.Macvtap)
+	if !ok || mv.Mode != netlink.MACVLAN_MODE_SOURCE {
+		return false, nil
+	}
+	if err := netlink.MacvlanMACAddrSet(link, macs); err != nil {
+		return true, fmt.Errorf("failed to set the source MAC addresses of %q: %v", name, err)
+	}
+	return true, nil
+}
+
+// LinkQueues returns the number of transmit queues of the link with the given
+// name in the current netns.
+func LinkQueues(name string) (int, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lookup link %q: %v", name, err)
+	}
+	return link.Attrs().NumTxQueues, nil
+}
+
+// LinkStatistics returns the statistics of the link with the given name in
+// the current netns.
+func LinkStatistics(name string) (*netlink.LinkStatistics, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup link %q: %v", name, err)
+	}
+	if link.Attrs().Statistics == nil {
+		return nil, fmt.Errorf("no statistics for link %q", name)
+	}
+	return link.Attrs().Statistics, nil
+}
+
+// LinkIndexByName returns the index of the link with the given name in the
+// current netns.
+func LinkIndexByName(name string) (int, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lookup link %q: %v", name, err)
+	}
+	return link.Attrs().Index, nil
+}
+
+// LinkNameByIndex returns the name of the link with the given index in the
+// current netns.
+func LinkNameByIndex(index int) (string, error) {
+	link, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup link with index %d: %v", index, err)
+	}
+	return link.Attrs().Name, nil
+}
+
 func renameInterface(currentIface netlink.Link, newIfaceName string) (netlink.Link, error) {
 	currentIfaceName := currentIface.Attrs().Name
 	if err := ip.RenameLink(currentIfaceName, newIfaceName); err != nil {